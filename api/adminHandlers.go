@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isAdminCatalog tells whether the catalog may use /api/admin endpoints. Admin
+// catalogs are listed in ADMIN_CATALOG_IDS, separated with commas.
+func isAdminCatalog(catalogId int) bool {
+	for _, raw := range strings.Split(getEnv("ADMIN_CATALOG_IDS", ""), ",") {
+		if id, err := strconv.Atoi(strings.TrimSpace(raw)); err == nil && id == catalogId {
+			return true
+		}
+	}
+	return false
+}
+
+func createAdminHandler(d DBService, rehash *RehashRunner) CollectionHandlerWrapper {
+	handler := withSubroutes("/api/admin", map[string]CollectionRequestHandler{
+		"rehash":   createRehashHandler(d, rehash),
+		"photo-gc": createPhotoCollectorHandler(d),
+	}, func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		notFound(w, r)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if !isAdminCatalog(catalogId) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r, catalogId)
+	}
+}
+
+func createRehashHandler(d DBService, rehash *RehashRunner) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method == "GET" {
+			job, err := d.GetLatestRehashJob()
+			if err == sql.ErrNoRows {
+				http.Error(w, "No rehash job has run yet", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the rehash job", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(job)
+			return
+		}
+
+		if r.Method == "POST" {
+			job, err := rehash.Start()
+			if err == errRehashRunning {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with starting the rehash job", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createPhotoCollectorHandler serves /api/admin/photo-gc: GET reports the
+// orphaned photos a collection would take, POST collects them right away.
+// Both respond with an OrphanReport.
+func createPhotoCollectorHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method != "GET" && r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Listing a remote blob store takes a while
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+		defer cancel()
+
+		now := time.Now()
+		report, err := d.CollectOrphanedPhotos(ctx, now.Add(-photoCollectorGrace()), now.Add(-photoQuarantineRetention()), photoCollectorAction(), r.Method == "GET")
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with collecting orphaned photos", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	AttributeText    = "text"
+	AttributeNumber  = "number"
+	AttributeDate    = "date"
+	AttributeEnum    = "enum"
+	AttributeBoolean = "boolean"
+)
+
+var attributeTypes = []string{AttributeText, AttributeNumber, AttributeDate, AttributeEnum, AttributeBoolean}
+
+// attributeKeyPattern keeps keys usable as query parameters (attr.<key>).
+var attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var (
+	errAttributeNotFound = errors.New("attribute not found")
+	errAttributeKeyTaken = errors.New("an attribute with this key already exists in the catalog")
+	errInvalidAttribute  = errors.New("invalid attribute")
+)
+
+// AttributeDefinition describes a typed field the items of a catalog can have.
+// Enum attributes take one of their options.
+type AttributeDefinition struct {
+	Id       int      `json:"id"`
+	Key      string   `json:"key"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Options  []string `json:"options"`
+	Required bool     `json:"required"`
+}
+
+// attributeValue is a validated item attribute, kept in the column of its type.
+type attributeValue struct {
+	Text   sql.NullString
+	Number sql.NullFloat64
+	Date   sql.NullTime
+	Bool   sql.NullBool
+}
+
+// json turns the stored value back into what the client sent.
+func (v attributeValue) json() interface{} {
+	switch {
+	case v.Text.Valid:
+		return v.Text.String
+	case v.Number.Valid:
+		return v.Number.Float64
+	case v.Date.Valid:
+		return v.Date.Time.Format(time.DateOnly)
+	case v.Bool.Valid:
+		return v.Bool.Bool
+	}
+	return nil
+}
+
+// parseAttributeValue checks that raw is a valid value for the attribute:
+// a string for text, a JSON number, a date like 2024-05-31, one of the options
+// of an enum, or true/false.
+func parseAttributeValue(def AttributeDefinition, raw json.RawMessage) (attributeValue, error) {
+	var v attributeValue
+	var err error
+	switch def.Type {
+	case AttributeText, AttributeEnum:
+		err = json.Unmarshal(raw, &v.Text.String)
+		v.Text.Valid = err == nil
+		if err == nil && def.Type == AttributeEnum && !slices.Contains(def.Options, v.Text.String) {
+			return attributeValue{}, fmt.Errorf("attribute %s must be one of %s: %w", def.Key, strings.Join(def.Options, ", "), errInvalidAttribute)
+		}
+	case AttributeNumber:
+		err = json.Unmarshal(raw, &v.Number.Float64)
+		v.Number.Valid = err == nil
+	case AttributeDate:
+		var s string
+		if err = json.Unmarshal(raw, &s); err == nil {
+			v.Date.Time, err = time.Parse(time.DateOnly, s)
+			v.Date.Valid = err == nil
+		}
+	case AttributeBoolean:
+		err = json.Unmarshal(raw, &v.Bool.Bool)
+		v.Bool.Valid = err == nil
+	}
+	if err != nil {
+		return attributeValue{}, fmt.Errorf("attribute %s must be a %s value: %w", def.Key, def.Type, errInvalidAttribute)
+	}
+	return v, nil
+}
+
+// validateAttributes checks item attribute values keyed by attribute key
+// against the catalog's definitions. A null value removes the attribute, which
+// maps to a nil entry. With requireAll every required attribute must be given.
+func validateAttributes(defs []AttributeDefinition, values map[string]json.RawMessage, requireAll bool) (map[int]*attributeValue, error) {
+	byKey := make(map[string]AttributeDefinition, len(defs))
+	for _, def := range defs {
+		byKey[def.Key] = def
+	}
+
+	validated := make(map[int]*attributeValue, len(values))
+	for key, raw := range values {
+		def, ok := byKey[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute %s: %w", key, errInvalidAttribute)
+		}
+		if raw == nil || string(raw) == "null" {
+			if def.Required {
+				return nil, fmt.Errorf("attribute %s is required: %w", key, errInvalidAttribute)
+			}
+			validated[def.Id] = nil
+			continue
+		}
+		v, err := parseAttributeValue(def, raw)
+		if err != nil {
+			return nil, err
+		}
+		validated[def.Id] = &v
+	}
+
+	if requireAll {
+		for _, def := range defs {
+			if v, ok := validated[def.Id]; def.Required && (!ok || v == nil) {
+				return nil, fmt.Errorf("attribute %s is required: %w", def.Key, errInvalidAttribute)
+			}
+		}
+	}
+	return validated, nil
+}
+
+// storeAttributes writes validated attribute values of the item, deleting the
+// ones mapped to nil. Attributes not in the map are left as they are.
+func storeAttributes(ctx context.Context, tx *sql.Tx, itemId int64, values map[int]*attributeValue) error {
+	for attributeId, v := range values {
+		if v == nil {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM item_attributes WHERE item_id = $1 AND attribute_id = $2", itemId, attributeId); err != nil {
+				return fmt.Errorf("storeAttributes delete: %w", err)
+			}
+			continue
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO item_attributes(item_id, attribute_id, value_text, value_number, value_date, value_bool)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (item_id, attribute_id) DO UPDATE
+			SET value_text = $3, value_number = $4, value_date = $5, value_bool = $6
+		`, itemId, attributeId, v.Text, v.Number, v.Date, v.Bool)
+		if err != nil {
+			return fmt.Errorf("storeAttributes upsert: %w", err)
+		}
+	}
+	return nil
+}
+
+// attachAttributes loads the attribute values of the given items.
+func (c DBService) attachAttributes(items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(items))
+	byId := make(map[int]*Item, len(items))
+	for i := range items {
+		ids[i] = items[i].Id
+		items[i].Attributes = map[string]interface{}{}
+		byId[items[i].Id] = &items[i]
+	}
+
+	result, err := c.DB.Query(`
+		SELECT a.item_id, d.key, a.value_text, a.value_number, a.value_date, a.value_bool
+		FROM item_attributes a
+		INNER JOIN attribute_definitions d ON d.id = a.attribute_id
+		WHERE a.item_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("attachAttributes query: %w", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var itemId int
+		var key string
+		var v attributeValue
+		if err := result.Scan(&itemId, &key, &v.Text, &v.Number, &v.Date, &v.Bool); err != nil {
+			return fmt.Errorf("attachAttributes scan: %w", err)
+		}
+		if item, ok := byId[itemId]; ok {
+			item.Attributes[key] = v.json()
+		}
+	}
+	return result.Err()
+}
+
+// Definitions
+
+const attributeDefinitionColumns = "id, key, label, type, options, required"
+
+func scanAttributeDefinition(row interface{ Scan(...any) error }) (AttributeDefinition, error) {
+	var def AttributeDefinition
+	err := row.Scan(&def.Id, &def.Key, &def.Label, &def.Type, pq.Array(&def.Options), &def.Required)
+	if def.Options == nil {
+		def.Options = []string{}
+	}
+	return def, err
+}
+
+// GetAttributeDefinitions lists the catalog's attribute definitions by key.
+func (c DBService) GetAttributeDefinitions(catalogId int) ([]AttributeDefinition, error) {
+	result, err := c.DB.Query("SELECT "+attributeDefinitionColumns+" FROM attribute_definitions WHERE catalog_id = $1 ORDER BY key", catalogId)
+	if err != nil {
+		return nil, fmt.Errorf("GetAttributeDefinitions query: %w", err)
+	}
+	defer result.Close()
+
+	defs := []AttributeDefinition{}
+	for result.Next() {
+		def, err := scanAttributeDefinition(result)
+		if err != nil {
+			return nil, fmt.Errorf("GetAttributeDefinitions scan: %w", err)
+		}
+		defs = append(defs, def)
+	}
+	return defs, result.Err()
+}
+
+func (c DBService) GetAttributeDefinition(attributeId int, catalogId int) (AttributeDefinition, error) {
+	row := c.DB.QueryRow("SELECT "+attributeDefinitionColumns+" FROM attribute_definitions WHERE id = $1 AND catalog_id = $2", attributeId, catalogId)
+	def, err := scanAttributeDefinition(row)
+	if err == sql.ErrNoRows {
+		return AttributeDefinition{}, fmt.Errorf("GetAttributeDefinition %d: %w", attributeId, errAttributeNotFound)
+	}
+	if err != nil {
+		return AttributeDefinition{}, fmt.Errorf("GetAttributeDefinition: %w", err)
+	}
+	return def, nil
+}
+
+// validateAttributeOptions makes sure enums have distinct, non-empty options
+// and other types have none.
+func validateAttributeOptions(attributeType string, options []string) error {
+	if attributeType != AttributeEnum {
+		if len(options) > 0 {
+			return fmt.Errorf("only enum attributes have options: %w", errInvalidAttribute)
+		}
+		return nil
+	}
+	if len(options) == 0 {
+		return fmt.Errorf("enum attributes need at least one option: %w", errInvalidAttribute)
+	}
+	seen := make(map[string]bool, len(options))
+	for _, option := range options {
+		if strings.TrimSpace(option) == "" || seen[option] {
+			return fmt.Errorf("enum options must be distinct and not empty: %w", errInvalidAttribute)
+		}
+		seen[option] = true
+	}
+	return nil
+}
+
+// InsertAttributeDefinition adds an attribute definition to the catalog.
+func (c DBService) InsertAttributeDefinition(catalogId int, def AttributeDefinition) (AttributeDefinition, error) {
+	if !attributeKeyPattern.MatchString(def.Key) {
+		return AttributeDefinition{}, fmt.Errorf("key must be lowercase letters, digits and underscores: %w", errInvalidAttribute)
+	}
+	if !slices.Contains(attributeTypes, def.Type) {
+		return AttributeDefinition{}, fmt.Errorf("type must be one of %s: %w", strings.Join(attributeTypes, ", "), errInvalidAttribute)
+	}
+	if def.Options == nil {
+		def.Options = []string{}
+	}
+	if err := validateAttributeOptions(def.Type, def.Options); err != nil {
+		return AttributeDefinition{}, err
+	}
+	if strings.TrimSpace(def.Label) == "" {
+		def.Label = def.Key
+	}
+
+	var id int
+	err := c.DB.QueryRow(`
+		INSERT INTO attribute_definitions(catalog_id, key, label, type, options, required)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (catalog_id, key) DO NOTHING
+		RETURNING id
+	`, catalogId, def.Key, def.Label, def.Type, pq.Array(def.Options), def.Required).Scan(&id)
+	if err == sql.ErrNoRows {
+		return AttributeDefinition{}, fmt.Errorf("InsertAttributeDefinition %s: %w", def.Key, errAttributeKeyTaken)
+	}
+	if err != nil {
+		return AttributeDefinition{}, fmt.Errorf("InsertAttributeDefinition: %w", err)
+	}
+	return c.GetAttributeDefinition(id, catalogId)
+}
+
+// PatchAttributeDefinitionPayload holds the definition fields to change. The
+// key and type of an attribute are fixed once items may carry it.
+type PatchAttributeDefinitionPayload struct {
+	Label    *string  `json:"label"`
+	Options  []string `json:"options"`
+	Required *bool    `json:"required"`
+}
+
+// UpdateAttributeDefinition changes the label, options or required flag of
+// the attribute. Enum options still used by items can't be removed.
+func (c DBService) UpdateAttributeDefinition(attributeId int, catalogId int, payload PatchAttributeDefinitionPayload, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("UpdateAttributeDefinition begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "SELECT "+attributeDefinitionColumns+" FROM attribute_definitions WHERE id = $1 AND catalog_id = $2 FOR UPDATE", attributeId, catalogId)
+	def, err := scanAttributeDefinition(row)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("UpdateAttributeDefinition %d: %w", attributeId, errAttributeNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("UpdateAttributeDefinition lookup: %w", err)
+	}
+
+	if payload.Label != nil {
+		if strings.TrimSpace(*payload.Label) == "" {
+			return fmt.Errorf("label can't be empty: %w", errInvalidAttribute)
+		}
+		def.Label = *payload.Label
+	}
+	if payload.Required != nil {
+		def.Required = *payload.Required
+	}
+	if payload.Options != nil {
+		if err := validateAttributeOptions(def.Type, payload.Options); err != nil {
+			return err
+		}
+		var used sql.NullString
+		err := tx.QueryRowContext(ctx, `
+			SELECT min(value_text) FROM item_attributes
+			WHERE attribute_id = $1 AND NOT value_text = ANY($2)
+		`, attributeId, pq.Array(payload.Options)).Scan(&used)
+		if err != nil {
+			return fmt.Errorf("UpdateAttributeDefinition check options: %w", err)
+		}
+		if used.Valid {
+			return fmt.Errorf("option %q is still used by items: %w", used.String, errInvalidAttribute)
+		}
+		def.Options = payload.Options
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE attribute_definitions SET label = $1, options = $2, required = $3 WHERE id = $4",
+		def.Label, pq.Array(def.Options), def.Required, attributeId)
+	if err != nil {
+		return fmt.Errorf("UpdateAttributeDefinition update: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateAttributeDefinition commit: %w", err)
+	}
+	return nil
+}
+
+// DeleteAttributeDefinition removes the attribute and its values from all items.
+func (c DBService) DeleteAttributeDefinition(attributeId int, catalogId int, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("DeleteAttributeDefinition begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existingId int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM attribute_definitions WHERE id = $1 AND catalog_id = $2 FOR UPDATE", attributeId, catalogId).Scan(&existingId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("DeleteAttributeDefinition %d: %w", attributeId, errAttributeNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("DeleteAttributeDefinition lookup: %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM item_attributes WHERE attribute_id = $1", attributeId); err != nil {
+		return fmt.Errorf("DeleteAttributeDefinition values: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM attribute_definitions WHERE id = $1", attributeId); err != nil {
+		return fmt.Errorf("DeleteAttributeDefinition: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("DeleteAttributeDefinition commit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func createAttributesCollectionHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method == "GET" {
+			defs, err := d.GetAttributeDefinitions(catalogId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting attributes", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(defs)
+			return
+		}
+
+		if r.Method == "POST" {
+			var payload AttributeDefinition
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+
+			def, err := d.InsertAttributeDefinition(catalogId, payload)
+			if errors.Is(err, errInvalidAttribute) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, errAttributeKeyTaken) {
+				http.Error(w, "An attribute with this key already exists", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Could not create an attribute", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(def)
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createAttributesResourceHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		if r.Method == "GET" {
+			def, err := d.GetAttributeDefinition(id, catalogId)
+			if errors.Is(err, errAttributeNotFound) {
+				http.Error(w, "Attribute not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the attribute", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(def)
+			return
+		}
+
+		if r.Method == "PATCH" {
+			var payload PatchAttributeDefinitionPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+
+			err := d.UpdateAttributeDefinition(id, catalogId, payload, ctx)
+			if errors.Is(err, errAttributeNotFound) {
+				http.Error(w, "Attribute not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errInvalidAttribute) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with updating the attribute", http.StatusInternalServerError)
+				return
+			}
+
+			def, err := d.GetAttributeDefinition(id, catalogId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the attribute", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(def)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			err := d.DeleteAttributeDefinition(id, catalogId, ctx)
+			if errors.Is(err, errAttributeNotFound) {
+				http.Error(w, "Attribute not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with deleting the attribute", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+type BlobInfo struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// BlobStore keeps binary objects such as photos under string keys like
+// "photos/12/3f9a...". Keys are made by the server, never by clients.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns errBlobNotFound when there is nothing under the key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds when there is nothing under the key.
+	Delete(ctx context.Context, key string) error
+	// List returns all blobs whose keys start with the prefix.
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// newBlobStoreFromEnv picks the store named by BLOB_STORE: "local" (the
+// default) keeps blobs under BLOB_DIR, "s3" in an S3-compatible bucket.
+func newBlobStoreFromEnv() (BlobStore, error) {
+	switch kind := getEnv("BLOB_STORE", "local"); kind {
+	case "local":
+		return NewLocalBlobStore(getEnv("BLOB_DIR", "data/blobs"))
+	case "s3":
+		return NewS3BlobStore(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          getEnv("S3_REGION", "us-east-1"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyId:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       getEnv("S3_PATH_STYLE", "true") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q, use local or s3", kind)
+	}
+}
+
+// validBlobKey accepts relative slash-separated keys without empty, "." or
+// ".." segments.
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, `\`) {
+			return false
+		}
+	}
+	return true
+}
+
+// LocalBlobStore keeps blobs as files under a directory.
+type LocalBlobStore struct {
+	Dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("NewLocalBlobStore: %w", err)
+	}
+	return &LocalBlobStore{Dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so that readers never see half a blob.
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("LocalBlobStore.Put: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("LocalBlobStore.Put: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("LocalBlobStore.Put write: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("LocalBlobStore.Put close: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("LocalBlobStore.Put rename: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("LocalBlobStore.Get %s: %w", key, errBlobNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LocalBlobStore.Get: %w", err)
+	}
+	return f, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("LocalBlobStore.Delete: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	err := filepath.WalkDir(s.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if entry.IsDir() {
+			// Only descend into directories that may hold matching keys
+			if dir := key + "/"; rel != "." && !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir) {
+				return filepath.SkipDir
+			}
+			return ctx.Err()
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModifiedAt: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("LocalBlobStore.List: %w", err)
+	}
+	return blobs, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000 for
+	// MinIO or https://s3.eu-central-1.amazonaws.com.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	// PathStyle addresses objects as {endpoint}/{bucket}/{key} instead of
+	// {bucket}.{endpoint host}/{key}; MinIO needs it.
+	PathStyle bool
+}
+
+// S3BlobStore keeps blobs in a bucket of an S3-compatible service. Requests
+// are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("NewS3BlobStore: S3_ENDPOINT and S3_BUCKET are required")
+	}
+	if config.AccessKeyId == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("NewS3BlobStore: S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("NewS3BlobStore: invalid S3_ENDPOINT %q", config.Endpoint)
+	}
+	return &S3BlobStore{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// objectUrl addresses the object under key, or the bucket when key is empty.
+func (s *S3BlobStore) objectUrl(key string) url.URL {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		path += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = path + "/" + key
+	u.RawPath = awsUriEscape(path, false) + "/" + awsUriEscape(key, false)
+	return u
+}
+
+func (s *S3BlobStore) do(ctx context.Context, method string, key string, body []byte, contentType string) (*http.Response, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	return s.send(ctx, method, s.objectUrl(key), body, contentType)
+}
+
+func (s *S3BlobStore) send(ctx context.Context, method string, u url.URL, body []byte, contentType string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the Authorization header of AWS Signature Version 4 to the
+// request, signing the whole payload.
+func (s *S3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers["content-type"] = contentType
+		names = append([]string{"content-type"}, names...)
+	}
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSha256(key, s.config.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsUriEscape percent-encodes everything but the unreserved characters, the
+// way Signature Version 4 expects. Slashes are kept unless encodeSlash is set.
+func awsUriEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name, the only form
+// Signature Version 4 accepts.
+func canonicalQuery(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = awsUriEscape(name, true) + "=" + awsUriEscape(params[name], true)
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Error reads the error the service responded with.
+func s3Error(op string, key string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+	return fmt.Errorf("S3BlobStore.%s %s: %s %s", op, key, res.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	res, err := s.do(ctx, "PUT", key, data, contentType)
+	if err != nil {
+		return fmt.Errorf("S3BlobStore.Put: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error("Put", key, res)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, "GET", key, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("S3BlobStore.Get: %w", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, fmt.Errorf("S3BlobStore.Get %s: %w", key, errBlobNotFound)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error("Get", key, res)
+	}
+	return res.Body, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, "DELETE", key, nil, "")
+	if err != nil {
+		return fmt.Errorf("S3BlobStore.Delete: %w", err)
+	}
+	defer res.Body.Close()
+	// Deleting a missing object succeeds with 204 as well
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return s3Error("Delete", key, res)
+	}
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2 until all matching objects are seen.
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	token := ""
+	for {
+		params := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			params["continuation-token"] = token
+		}
+		u := s.objectUrl("")
+		u.RawQuery = canonicalQuery(params)
+
+		res, err := s.send(ctx, "GET", u, nil, "")
+		if err != nil {
+			return nil, fmt.Errorf("S3BlobStore.List: %w", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return nil, s3Error("List", prefix, res)
+		}
+		var page s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3BlobStore.List decode: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			blobs = append(blobs, BlobInfo{Key: object.Key, Size: object.Size, ModifiedAt: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
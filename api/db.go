@@ -2,16 +2,15 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"database/sql"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func initializeDB() *sql.DB {
@@ -25,7 +24,9 @@ func initializeDB() *sql.DB {
 }
 
 type DBService struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Index *FingerprintIndex
+	Blobs BlobStore
 }
 
 type Catalog struct {
@@ -34,36 +35,45 @@ type Catalog struct {
 	Password string
 }
 
-func (c DBService) findCatalogByPasswordHash(password string) (Catalog, error) {
-	hash := md5.Sum([]byte(password))
-	hashedPassword := base64.StdEncoding.EncodeToString(hash[:])
-
-	row := c.DB.QueryRow("select id, name from catalogs where password = $1", hashedPassword)
-	var cat Catalog
-	if err := row.Scan(&cat.Id, &cat.Name); err != nil {
-		return Catalog{}, err
-	}
-	return cat, nil
-}
-
 // Items
 
 type Item struct {
-	Id          int       `json:"id"`
-	Name        string    `json:"name"`
-	FingerPrint string    `json:"fingerprint"`
-	PhotoUrl    string    `json:"photoUrl"`
-	CreatedAt   time.Time `json:"createdAt"`
-	Tags        []TagItem `json:"tags"`
+	Id           int           `json:"id"`
+	Name         string        `json:"name"`
+	FingerPrint  string        `json:"fingerprint"`
+	Fingerprints []Fingerprint `json:"fingerprints"`
+	PhotoUrl     string        `json:"photoUrl"`
+	// PhotoVariants are set for photos kept by the server.
+	PhotoVariants *PhotoVariantUrls `json:"photoVariants,omitempty"`
+	// PhotoCount is the number of photos of the item, photoUrl being the
+	// primary one.
+	PhotoCount int        `json:"photoCount"`
+	Quantity   int        `json:"quantity"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	DeletedAt  *time.Time `json:"deletedAt,omitempty"`
+	Tags       []TagItem  `json:"tags"`
+	// Attributes maps attribute keys to their values.
+	Attributes map[string]interface{} `json:"attributes"`
 }
 
-func (c DBService) getAllItems(catalogId int) ([]Item, error) {
-	query := `
-		SELECT i.id, i.name, i.fingerprint, i.photo_url, i.created_at, t.id, t.name
+// photoCountExpr counts the stored photos of item i, or its photo kept
+// elsewhere.
+const photoCountExpr = `greatest((SELECT count(*) FROM item_photos ip WHERE ip.item_id = i.id), CASE WHEN coalesce(i.photo_url, '') <> '' THEN 1 ELSE 0 END)`
+
+// itemsWithTagsQuery selects the columns scanItemsWithTags expects; callers
+// add the WHERE and ORDER BY clauses.
+const itemsWithTagsQuery = `
+		SELECT i.id, i.name, i.fingerprint, i.photo_url, i.photo_id, ` + photoCountExpr + `, i.quantity, i.status, i.created_at, i.updated_at, i.deleted_at, t.id, t.name
 		FROM items i
 		LEFT JOIN items_tags it ON i.id = it.item_id
 		LEFT JOIN tags t ON it.tag_id = t.id
-		WHERE i.catalog_id = $1
+`
+
+func (c DBService) getAllItems(catalogId int) ([]Item, error) {
+	query := itemsWithTagsQuery + `
+		WHERE i.catalog_id = $1 AND i.deleted_at IS NULL
 		ORDER BY i.id, t.name
 	`
 	result, err := c.DB.Query(query, catalogId)
@@ -72,19 +82,63 @@ func (c DBService) getAllItems(catalogId int) ([]Item, error) {
 	}
 	defer result.Close()
 
+	items, err := scanItemsWithTags(result)
+	if err != nil {
+		return []Item{}, err
+	}
+	if err := c.attachFingerprints(items); err != nil {
+		return []Item{}, err
+	}
+	if err := c.attachAttributes(items); err != nil {
+		return []Item{}, err
+	}
+	return items, nil
+}
+
+// getItemsByIds returns items of the catalog with the given ids, with their tags.
+// Ids that don't exist in the catalog or are in the trash are skipped.
+func (c DBService) getItemsByIds(catalogId int, ids []int) ([]Item, error) {
+	query := itemsWithTagsQuery + `
+		WHERE i.catalog_id = $1 AND i.id = ANY($2) AND i.deleted_at IS NULL
+		ORDER BY i.id, t.name
+	`
+	result, err := c.DB.Query(query, catalogId, pq.Array(ids))
+	if err != nil {
+		return []Item{}, err
+	}
+	defer result.Close()
+
+	items, err := scanItemsWithTags(result)
+	if err != nil {
+		return []Item{}, err
+	}
+	if err := c.attachFingerprints(items); err != nil {
+		return []Item{}, err
+	}
+	if err := c.attachAttributes(items); err != nil {
+		return []Item{}, err
+	}
+	return items, nil
+}
+
+// scanItemsWithTags folds rows of (item columns, tag id, tag name) into items,
+// expecting rows of the same item to be next to each other.
+func scanItemsWithTags(result *sql.Rows) ([]Item, error) {
 	// Use a map to group tags by item ID
 	itemsMap := make(map[int]*Item)
 	var itemOrder []int
 
 	for result.Next() {
-		var itemId int
-		var name, fingerprint string
+		var itemId, photoCount, quantity int
+		var name, fingerprint, status string
 		var photoUrl sql.NullString
-		var createdAt time.Time
+		var photoId sql.NullInt64
+		var createdAt, updatedAt time.Time
+		var deletedAt sql.NullTime
 		var tagId sql.NullInt64
 		var tagName sql.NullString
 
-		if err := result.Scan(&itemId, &name, &fingerprint, &photoUrl, &createdAt, &tagId, &tagName); err != nil {
+		if err := result.Scan(&itemId, &name, &fingerprint, &photoUrl, &photoId, &photoCount, &quantity, &status, &createdAt, &updatedAt, &deletedAt, &tagId, &tagName); err != nil {
 			return []Item{}, err
 		}
 
@@ -95,9 +149,19 @@ func (c DBService) getAllItems(catalogId int) ([]Item, error) {
 				Name:        name,
 				FingerPrint: fingerprint,
 				PhotoUrl:    photoUrl.String,
+				PhotoCount:  photoCount,
+				Quantity:    quantity,
+				Status:      status,
 				CreatedAt:   createdAt,
+				UpdatedAt:   updatedAt,
 				Tags:        []TagItem{},
 			}
+			if deletedAt.Valid {
+				item.DeletedAt = &deletedAt.Time
+			}
+			if photoId.Valid {
+				item.PhotoVariants = photoVariantUrls(int(photoId.Int64))
+			}
 			itemsMap[itemId] = item
 			itemOrder = append(itemOrder, itemId)
 		}
@@ -106,6 +170,9 @@ func (c DBService) getAllItems(catalogId int) ([]Item, error) {
 			item.Tags = append(item.Tags, TagItem{Id: tagId.Int64, Name: tagName.String})
 		}
 	}
+	if err := result.Err(); err != nil {
+		return []Item{}, err
+	}
 
 	// Build result slice preserving order
 	items := make([]Item, 0, len(itemOrder))
@@ -144,9 +211,14 @@ func fail(err error) (int64, error) {
 	return 0, fmt.Errorf("createNewItem: %v", err)
 }
 
-var insertStmt = "INSERT into items(name, fingerprint, catalog_id, photo_url, fingerprint_bigint) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+var insertStmt = "INSERT into items(name, fingerprint, catalog_id, photo_url, fingerprint_bigint, quantity, status) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id"
 
-func (c DBService) CreateNewItem(payload PostNewItemPayload, catalogId int, ctx context.Context) (int64, error) {
+// CreateNewItem stores a new item with its tags, fingerprints and attribute
+// values, which must have been checked with validateNewItem. Creates in a
+// catalog run one at a time, and the item is indexed before the next one
+// starts, so that check, when given, sees every item created before; an
+// error from it stops the create.
+func (c DBService) CreateNewItem(payload PostNewItemPayload, attributes map[int]*attributeValue, catalogId int, check func() error, ctx context.Context) (int64, error) {
 	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return fail(err)
@@ -154,16 +226,46 @@ func (c DBService) CreateNewItem(payload PostNewItemPayload, catalogId int, ctx
 	// Defer a rollback in case anything fails.
 	defer tx.Rollback()
 
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('item_create'), $1)", catalogId); err != nil {
+		return fail(err)
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, err
+		}
+	}
+
 	var itemID int64
-	fingerPrintBigInt, err := binaryToBigInt(payload.Fingerprint)
+	fingerprints, err := fingerprintsForPayload(payload.Fingerprint, payload.Fingerprints)
+	if err != nil {
+		return fail(err)
+	}
+	fingerprint, fingerPrintBigInt, err := legacyFingerprint(fingerprints)
 	if err != nil {
 		return fail(err)
 	}
 
-	if err := tx.QueryRowContext(ctx, insertStmt, payload.Name, payload.Fingerprint, catalogId, payload.PhotoUrl, fingerPrintBigInt).Scan(&itemID); err != nil {
+	status := payload.Status
+	if status == "" {
+		status = ItemStatusOwned
+	}
+	// Nothing of a wanted item is owned yet
+	quantity := 1
+	if status != ItemStatusOwned {
+		quantity = 0
+	}
+	if payload.Quantity != nil {
+		quantity = *payload.Quantity
+	}
+	if err := tx.QueryRowContext(ctx, insertStmt, payload.Name, fingerprint, catalogId, payload.PhotoUrl, fingerPrintBigInt, quantity, status).Scan(&itemID); err != nil {
 		fmt.Println(err)
 		return itemID, err
 	}
+	if quantity != 0 {
+		if err := recordQuantityChange(ctx, tx, itemID, quantity, quantity); err != nil {
+			return fail(err)
+		}
+	}
 
 	for _, t := range payload.Tags {
 		var tID int64
@@ -184,13 +286,147 @@ func (c DBService) CreateNewItem(payload PostNewItemPayload, catalogId int, ctx
 		}
 	}
 
-	// Commit the transaction.
+	if err := refreshSearchVectors(ctx, tx, int(itemID)); err != nil {
+		return fail(err)
+	}
+	if err := storeAttributes(ctx, tx, itemID, attributes); err != nil {
+		return fail(err)
+	}
+	if err := storeFingerprints(ctx, tx, itemID, fingerprints); err != nil {
+		return fail(err)
+	}
+
+	// Indexed while the lock is held; taken out again if the commit fails
+	c.indexFingerprints(catalogId, int(itemID), fingerprints)
 	if err = tx.Commit(); err != nil {
+		c.Index.Remove(catalogId, int(itemID))
 		return fail(err)
 	}
 	return itemID, nil
 }
 
+var errItemNotFound = errors.New("item not found")
+
+// GetItem returns a single item of the catalog with its tags.
+func (c DBService) GetItem(itemId int, catalogId int) (Item, error) {
+	items, err := c.getItemsByIds(catalogId, []int{itemId})
+	if err != nil {
+		return Item{}, fmt.Errorf("GetItem: %w", err)
+	}
+	if len(items) == 0 {
+		return Item{}, fmt.Errorf("GetItem %d: %w", itemId, errItemNotFound)
+	}
+	return items[0], nil
+}
+
+// UpdateItem changes the fields set in the payload. A new fingerprint replaces
+// all stored fingerprints of the item. Attribute values must have been checked
+// with validateAttributes.
+func (c DBService) UpdateItem(itemId int, catalogId int, payload PatchItemPayload, attributes map[int]*attributeValue, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("UpdateItem begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existingItemId int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL FOR UPDATE", itemId, catalogId).Scan(&existingItemId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("UpdateItem %d: %w", itemId, errItemNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("UpdateItem verify item: %w", err)
+	}
+
+	fingerprints, err := updateItemFields(ctx, tx, itemId, payload, attributes)
+	if err != nil {
+		return fmt.Errorf("UpdateItem: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateItem commit: %w", err)
+	}
+	if fingerprints != nil {
+		c.indexFingerprints(catalogId, itemId, fingerprints)
+	}
+	return nil
+}
+
+// updateItemFields applies the payload to a locked item and returns the new
+// fingerprints, if any, to be indexed once the transaction commits.
+func updateItemFields(ctx context.Context, tx *sql.Tx, itemId int, payload PatchItemPayload, attributes map[int]*attributeValue) ([]Fingerprint, error) {
+	if payload.Name != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE items SET name = $1 WHERE id = $2", *payload.Name, itemId); err != nil {
+			return nil, fmt.Errorf("updateItemFields name: %w", err)
+		}
+		if err := refreshSearchVectors(ctx, tx, itemId); err != nil {
+			return nil, err
+		}
+	}
+
+	if payload.PhotoUrl != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE items SET photo_url = $1 WHERE id = $2", *payload.PhotoUrl, itemId); err != nil {
+			return nil, fmt.Errorf("updateItemFields photo: %w", err)
+		}
+	}
+
+	if payload.Status != nil {
+		if err := setItemStatus(ctx, tx, itemId, *payload.Status, nil); err != nil {
+			return nil, fmt.Errorf("updateItemFields: %w", err)
+		}
+	}
+
+	var fingerprints []Fingerprint
+	if payload.Fingerprint != nil || payload.Fingerprints != nil {
+		var fingerprint string
+		if payload.Fingerprint != nil {
+			fingerprint = *payload.Fingerprint
+		}
+		var err error
+		fingerprints, err = fingerprintsForPayload(fingerprint, payload.Fingerprints)
+		if err != nil {
+			return nil, err
+		}
+		legacy, legacyBigInt, err := legacyFingerprint(fingerprints)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE items SET fingerprint = $1, fingerprint_bigint = $2 WHERE id = $3", legacy, legacyBigInt, itemId); err != nil {
+			return nil, fmt.Errorf("updateItemFields fingerprint: %w", err)
+		}
+		if err := storeFingerprints(ctx, tx, int64(itemId), fingerprints); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := storeAttributes(ctx, tx, int64(itemId), attributes); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET updated_at = now() WHERE id = $1", itemId); err != nil {
+		return nil, fmt.Errorf("updateItemFields updated_at: %w", err)
+	}
+	return fingerprints, nil
+}
+
+// TrashItem moves the item to the trash. Its tag links and fingerprints stay
+// so that it can be restored as it was.
+func (c DBService) TrashItem(itemId int, catalogId int, ctx context.Context) error {
+	result, err := c.DB.ExecContext(ctx, "UPDATE items SET deleted_at = now() WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL", itemId, catalogId)
+	if err != nil {
+		return fmt.Errorf("TrashItem: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("TrashItem: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("TrashItem %d: %w", itemId, errItemNotFound)
+	}
+	c.Index.Remove(catalogId, itemId)
+	return nil
+}
+
 const (
 	HashWidth  = 9  // Required for 8 comparisons
 	HashHeight = 8  // 8 rows of comparisons
@@ -212,35 +448,120 @@ func binaryToBigInt(hexString string) (int64, error) {
 	return bigIntHash, nil
 }
 
+// Similarity
+
+type SimilarItem struct {
+	Distance  float64        `json:"distance"`
+	Distances map[string]int `json:"distances"`
+	// Match tells what the match means for the scan, see similarityMatches.
+	Match string `json:"match"`
+	Item  Item   `json:"item"`
+}
+
+type fingerprintMatch struct {
+	ItemId   int
+	Distance int
+}
+
+// FindSimilarItems ranks items of the catalog by the weighted Hamming distance
+// between their fingerprints and the given ones, closest first.
+func (c DBService) FindSimilarItems(catalogId int, queries []fingerprintQuery, maxDistance int, limit int) ([]SimilarItem, error) {
+	matches := c.Index.Search(catalogId, queries, maxDistance, limit)
+	return c.resolveFingerprintMatches(catalogId, matches)
+}
+
+// FindDuplicateCandidates lists items of the catalog that look like the item
+// described by the payload's fingerprints.
+func (c DBService) FindDuplicateCandidates(catalogId int, payload PostNewItemPayload, maxDistance int) ([]SimilarItem, error) {
+	fingerprints, err := fingerprintsForPayload(payload.Fingerprint, payload.Fingerprints)
+	if err != nil {
+		return []SimilarItem{}, err
+	}
+	queries, err := queriesForFingerprints(fingerprints, defaultHashWeights)
+	if err != nil {
+		return []SimilarItem{}, err
+	}
+	return c.FindSimilarItems(catalogId, queries, maxDistance, maxDuplicateCandidates)
+}
+
+// resolveFingerprintMatches loads the matched items with their tags, keeping the
+// order of matches.
+func (c DBService) resolveFingerprintMatches(catalogId int, matches []weightedMatch) ([]SimilarItem, error) {
+	if len(matches) == 0 {
+		return []SimilarItem{}, nil
+	}
+
+	ids := make([]int, len(matches))
+	for i, m := range matches {
+		ids[i] = m.ItemId
+	}
+	items, err := c.getItemsByIds(catalogId, ids)
+	if err != nil {
+		return []SimilarItem{}, fmt.Errorf("resolveFingerprintMatches items: %w", err)
+	}
+	itemsById := make(map[int]Item, len(items))
+	for _, item := range items {
+		itemsById[item.Id] = item
+	}
+
+	similar := make([]SimilarItem, 0, len(matches))
+	for _, m := range matches {
+		item, ok := itemsById[m.ItemId]
+		if !ok {
+			continue
+		}
+		similar = append(similar, SimilarItem{Distance: m.Distance, Distances: m.Distances, Match: similarityMatches[item.Status], Item: item})
+	}
+	return similar, nil
+}
+
 // Tags
 
-func (c DBService) GetTagsByQuery(catalogId int, query string) ([]TagItem, error) {
-	// Search for tags that match the query (case-insensitive partial match)
-	result, err := c.DB.Query(
-		"select id, name from tags where catalog_id = $1 and name ILIKE $2 order by name limit 10",
-		catalogId,
-		"%"+query+"%",
-	)
+// GetTagsByQuery suggests tags for autocomplete. Tags containing the query
+// or close to it by trigram similarity match, so typos still find them.
+// Prefix matches come first, then the tags used by most items.
+func (c DBService) GetTagsByQuery(catalogId int, query string, limit int) ([]TagUsage, error) {
+	result, err := c.DB.Query(`
+		SELECT t.id, t.name, t.parent_id, count(i.id) AS usage
+		FROM tags t
+		LEFT JOIN items_tags it ON it.tag_id = t.id
+		LEFT JOIN items i ON i.id = it.item_id AND i.deleted_at IS NULL
+		WHERE t.catalog_id = $1 AND (t.name ILIKE '%' || $2::text || '%' OR t.name % $3::text OR $3::text <% t.name)
+		GROUP BY t.id
+		ORDER BY t.name ILIKE $2::text || '%' DESC, usage DESC, similarity(t.name, $3::text) DESC, t.name
+		LIMIT $4
+	`, catalogId, escapeLike(query), query, limit)
 	if err != nil {
-		return []TagItem{}, err
+		return []TagUsage{}, fmt.Errorf("GetTagsByQuery query: %w", err)
 	}
 	defer result.Close()
 
-	var tags = []TagItem{}
+	var tags = []TagUsage{}
 	for result.Next() {
-		var tag TagItem
-		if err := result.Scan(&tag.Id, &tag.Name); err != nil {
-			return []TagItem{}, err
+		var tag TagUsage
+		var parentId sql.NullInt64
+		if err := result.Scan(&tag.Id, &tag.Name, &parentId, &tag.Count); err != nil {
+			return []TagUsage{}, fmt.Errorf("GetTagsByQuery scan: %w", err)
 		}
+		tag.ParentId = nullableId(parentId)
 		tags = append(tags, tag)
 	}
 
-	return tags, nil
+	return tags, result.Err()
 }
 
+var errTagNotFound = errors.New("tag not found")
+
 type TagItem struct {
-	Id   int64  `json:"id"`
-	Name string `json:"name"`
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	ParentId *int64 `json:"parentId,omitempty"`
+}
+
+// TagUsage is a tag with the number of items in the catalog carrying it.
+type TagUsage struct {
+	TagItem
+	Count int `json:"count"`
 }
 
 func (c DBService) GetTagByNameInCatalog(catalogId int, name string) (int64, error) {
@@ -256,15 +577,40 @@ func (c DBService) GetTagByNameInCatalog(catalogId int, name string) (int64, err
 	return tagID, nil
 }
 
-func (c DBService) InsertNewTag(catalogId int, tagName string) (int64, error) {
-	existingID, err := c.GetTagByNameInCatalog(catalogId, tagName)
-
+// InsertNewTag creates a tag, optionally under a parent tag of the same
+// catalog. When the catalog already has a tag with the name, its id is
+// returned instead, unless it sits under another parent than the one asked
+// for.
+func (c DBService) InsertNewTag(catalogId int, tagName string, parentId *int64) (int64, error) {
+	var existingID int64
+	var existingParentId sql.NullInt64
+	err := c.DB.QueryRow("SELECT id, parent_id FROM tags WHERE name = $1 AND catalog_id = $2", tagName, catalogId).Scan(&existingID, &existingParentId)
 	if err == nil {
+		if parentId != nil && (!existingParentId.Valid || existingParentId.Int64 != *parentId) {
+			return 0, fmt.Errorf("InsertNewTag %q under another parent: %w", tagName, errTagNameTaken)
+		}
 		return existingID, nil
 	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("InsertNewTag lookup tag: %w", err)
+	}
+
+	if parentId != nil {
+		var parentTagId int64
+		err := c.DB.QueryRow("SELECT id FROM tags WHERE id = $1 AND catalog_id = $2", *parentId, catalogId).Scan(&parentTagId)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("parent tag %d: %w", *parentId, errTagNotFound)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("lookup parent tag: %w", err)
+		}
+	}
 
 	var id int64
-	err = c.DB.QueryRow("INSERT into tags(catalog_id, name) VALUES ($1, $2) returning id", catalogId, tagName).Scan(&id)
+	err = c.DB.QueryRow("INSERT into tags(catalog_id, name, parent_id) VALUES ($1, $2, $3) returning id", catalogId, tagName, parentId).Scan(&id)
+	if isUniqueViolation(err, tagNameConstraint) {
+		return 0, fmt.Errorf("InsertNewTag %q: %w", tagName, errTagNameTaken)
+	}
 	return id, err
 }
 
@@ -277,7 +623,7 @@ func (c DBService) UpdateItemTags(itemId int, catalogId int, tagIds []int, ctx c
 
 	// Verify item belongs to catalog
 	var existingItemId int
-	err = tx.QueryRowContext(ctx, "SELECT id FROM items WHERE id = $1 AND catalog_id = $2", itemId, catalogId).Scan(&existingItemId)
+	err = tx.QueryRowContext(ctx, "SELECT id FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL", itemId, catalogId).Scan(&existingItemId)
 	if err == sql.ErrNoRows {
 		return fmt.Errorf("item %d not found in catalog %d", itemId, catalogId)
 	}
@@ -309,6 +655,10 @@ func (c DBService) UpdateItemTags(itemId int, catalogId int, tagIds []int, ctx c
 		}
 	}
 
+	if err := refreshSearchVectors(ctx, tx, itemId); err != nil {
+		return fmt.Errorf("UpdateItemTags: %w", err)
+	}
+
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("UpdateItemTags commit: %w", err)
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type DuplicateCluster struct {
+	Items []Item `json:"items"`
+}
+
+// unionFind groups item indexes into disjoint sets.
+type unionFind struct {
+	parent []int
+	rank   []int
+}
+
+func newUnionFind(n int) *unionFind {
+	u := &unionFind{parent: make([]int, n), rank: make([]int, n)}
+	for i := range u.parent {
+		u.parent[i] = i
+	}
+	return u
+}
+
+func (u *unionFind) find(i int) int {
+	for u.parent[i] != i {
+		u.parent[i] = u.parent[u.parent[i]]
+		i = u.parent[i]
+	}
+	return i
+}
+
+func (u *unionFind) union(a, b int) {
+	ra, rb := u.find(a), u.find(b)
+	if ra == rb {
+		return
+	}
+	if u.rank[ra] < u.rank[rb] {
+		ra, rb = rb, ra
+	}
+	u.parent[rb] = ra
+	if u.rank[ra] == u.rank[rb] {
+		u.rank[ra]++
+	}
+}
+
+// clusterDuplicates groups items whose fingerprints are within maxDistance of
+// each other, directly or through a chain of neighbours. Only fingerprints of
+// the same algorithm and version are compared. Items without a neighbour are
+// left out. Bigger clusters come first.
+func clusterDuplicates(items []Item, maxDistance int) []DuplicateCluster {
+	indexes := make(map[hashKind]*bandIndex)
+	for i, item := range items {
+		for _, f := range item.Fingerprints {
+			hash, err := binaryToBigInt(f.Hash)
+			if err != nil {
+				continue
+			}
+			index, ok := indexes[f.kind()]
+			if !ok {
+				index = newBandIndex()
+				indexes[f.kind()] = index
+			}
+			index.add(i, hash)
+		}
+	}
+
+	sets := newUnionFind(len(items))
+	for _, index := range indexes {
+		for i, hashes := range index.hashes {
+			for _, hash := range hashes {
+				for _, m := range index.radius(hash, maxDistance) {
+					sets.union(i, m.ItemId)
+				}
+			}
+		}
+	}
+
+	groups := make(map[int][]Item)
+	var roots []int
+	for i, item := range items {
+		root := sets.find(i)
+		if _, ok := groups[root]; !ok {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], item)
+	}
+
+	clusters := []DuplicateCluster{}
+	for _, root := range roots {
+		if len(groups[root]) > 1 {
+			clusters = append(clusters, DuplicateCluster{Items: groups[root]})
+		}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].Items) > len(clusters[j].Items)
+	})
+	return clusters
+}
+
+// FindDuplicateClusters groups near-identical items of the catalog.
+func (c DBService) FindDuplicateClusters(catalogId int, maxDistance int) ([]DuplicateCluster, error) {
+	items, err := c.getAllItems(catalogId)
+	if err != nil {
+		return []DuplicateCluster{}, fmt.Errorf("FindDuplicateClusters: %w", err)
+	}
+	return clusterDuplicates(items, maxDistance), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestClusterDuplicatesComparesSameHashKind(t *testing.T) {
+	dhash := func(version int, hash int64) Fingerprint {
+		return Fingerprint{Algorithm: AlgorithmDHash, Version: version, Hash: fingerprintToHex(hash)}
+	}
+	items := []Item{
+		{Id: 1, Fingerprints: []Fingerprint{dhash(browserDHashVersion, 0x0f0f)}},
+		// Same bits as item 1, but a server dHash isn't comparable with a browser one
+		{Id: 2, Fingerprints: []Fingerprint{dhash(2, 0x0f0f)}},
+		{Id: 3, Fingerprints: []Fingerprint{dhash(2, 0x0f0e), dhash(browserDHashVersion, -1)}},
+	}
+
+	clusters := clusterDuplicates(items, 2)
+	if len(clusters) != 1 {
+		t.Fatalf("got %d clusters, want 1", len(clusters))
+	}
+	got := clusters[0].Items
+	if len(got) != 2 || got[0].Id != 2 || got[1].Id != 3 {
+		t.Fatalf("cluster = %v, want items 2 and 3", got)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"slices"
+	"sort"
+	"sync"
+)
+
+func hammingDistance(a, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// FingerprintIndex keeps a multi-index hash of item fingerprints per catalog
+// and kind of hash so that similarity queries don't have to scan the database. An item
+// may have several fingerprints of a kind, one per photo; it matches by the
+// closest of them.
+type FingerprintIndex struct {
+	mu       sync.RWMutex
+	catalogs map[int]map[hashKind]*bandIndex
+}
+
+func NewFingerprintIndex() *FingerprintIndex {
+	return &FingerprintIndex{catalogs: make(map[int]map[hashKind]*bandIndex)}
+}
+
+// Add indexes a fingerprint of the given kind for the item, next to the ones
+// it already has.
+func (x *FingerprintIndex) Add(catalogId int, itemId int, kind hashKind, fingerprint int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	indexes, ok := x.catalogs[catalogId]
+	if !ok {
+		indexes = make(map[hashKind]*bandIndex)
+		x.catalogs[catalogId] = indexes
+	}
+	index, ok := indexes[kind]
+	if !ok {
+		index = newBandIndex()
+		indexes[kind] = index
+	}
+	index.add(itemId, fingerprint)
+}
+
+// Remove drops all fingerprints of the item.
+func (x *FingerprintIndex) Remove(catalogId int, itemId int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, index := range x.catalogs[catalogId] {
+		index.remove(itemId)
+	}
+}
+
+// Radius returns all items within maxDistance of fingerprint, closest first.
+func (x *FingerprintIndex) Radius(catalogId int, kind hashKind, fingerprint int64, maxDistance int) []fingerprintMatch {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	index, ok := x.catalogs[catalogId][kind]
+	if !ok {
+		return []fingerprintMatch{}
+	}
+	matches := index.radius(fingerprint, maxDistance)
+	sortMatches(matches)
+	return matches
+}
+
+// Nearest returns up to k items closest to fingerprint that are within
+// maxDistance, closest first.
+func (x *FingerprintIndex) Nearest(catalogId int, kind hashKind, fingerprint int64, k int, maxDistance int) []fingerprintMatch {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	index, ok := x.catalogs[catalogId][kind]
+	if !ok || k <= 0 {
+		return []fingerprintMatch{}
+	}
+	return index.nearest(fingerprint, k, maxDistance)
+}
+
+type fingerprintQuery struct {
+	Kind   hashKind
+	Hash   int64
+	Weight float64
+}
+
+type weightedMatch struct {
+	ItemId    int
+	Distance  float64
+	Distances map[string]int
+}
+
+// Search combines several fingerprints of one scan: an item's distance is the
+// weighted mean of its per-algorithm distances, counting only the algorithms
+// the item has a fingerprint for. Up to limit items within maxDistance are
+// returned, closest first.
+func (x *FingerprintIndex) Search(catalogId int, queries []fingerprintQuery, maxDistance int, limit int) []weightedMatch {
+	active := []fingerprintQuery{}
+	for _, q := range queries {
+		if q.Weight > 0 {
+			active = append(active, q)
+		}
+	}
+	if len(active) == 0 || limit <= 0 {
+		return []weightedMatch{}
+	}
+
+	if len(active) == 1 {
+		q := active[0]
+		matches := []weightedMatch{}
+		for _, m := range x.Nearest(catalogId, q.Kind, q.Hash, limit, maxDistance) {
+			matches = append(matches, weightedMatch{
+				ItemId:    m.ItemId,
+				Distance:  float64(m.Distance),
+				Distances: map[string]int{q.Kind.Algorithm: m.Distance},
+			})
+		}
+		return matches
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	// A weighted mean is never below its smallest term, so every match is
+	// within maxDistance for at least one of the algorithms.
+	indexes := x.catalogs[catalogId]
+	candidates := make(map[int]bool)
+	for _, q := range active {
+		if index, ok := indexes[q.Kind]; ok {
+			for _, m := range index.radius(q.Hash, maxDistance) {
+				candidates[m.ItemId] = true
+			}
+		}
+	}
+
+	matches := []weightedMatch{}
+	for itemId := range candidates {
+		m := weightedMatch{ItemId: itemId, Distances: make(map[string]int)}
+		var sum, weights float64
+		for _, q := range active {
+			index, ok := indexes[q.Kind]
+			if !ok {
+				continue
+			}
+			hashes, ok := index.hashes[itemId]
+			if !ok {
+				continue
+			}
+			d := closestDistance(hashes, q.Hash)
+			m.Distances[q.Kind.Algorithm] = d
+			sum += q.Weight * float64(d)
+			weights += q.Weight
+		}
+		m.Distance = sum / weights
+		if m.Distance <= float64(maxDistance) {
+			matches = append(matches, m)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ItemId < matches[j].ItemId
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// closestDistance is the distance of hash to the closest of hashes.
+func closestDistance(hashes []int64, hash int64) int {
+	closest := HashBits + 1
+	for _, h := range hashes {
+		closest = min(closest, hammingDistance(h, hash))
+	}
+	return closest
+}
+
+// closestMatches keeps the closest match of every item.
+func closestMatches(matches []fingerprintMatch) []fingerprintMatch {
+	closest := make(map[int]int, len(matches))
+	for _, m := range matches {
+		if d, ok := closest[m.ItemId]; !ok || m.Distance < d {
+			closest[m.ItemId] = m.Distance
+		}
+	}
+	result := make([]fingerprintMatch, 0, len(closest))
+	for itemId, d := range closest {
+		result = append(result, fingerprintMatch{ItemId: itemId, Distance: d})
+	}
+	return result
+}
+
+func sortMatches(matches []fingerprintMatch) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ItemId < matches[j].ItemId
+	})
+}
+
+// Multi-index hashing
+
+const hashBands = 4 // of 16 bits each
+
+// maxBandProbeDistance is the farthest band neighbours are probed at; further
+// out enumerating them costs more than scanning every fingerprint.
+const maxBandProbeDistance = 2
+
+// bandIndex finds fingerprints within a distance by splitting them into
+// bands: when two fingerprints are within d of each other, one of their bands
+// is within d/4, so only fingerprints with a band that close are compared.
+type bandIndex struct {
+	hashes map[int][]int64               // item id -> indexed fingerprints
+	items  map[int64][]int               // fingerprint -> item ids
+	bands  [hashBands]map[uint32][]int64 // band value -> fingerprints
+}
+
+func newBandIndex() *bandIndex {
+	x := &bandIndex{hashes: make(map[int][]int64), items: make(map[int64][]int)}
+	for b := range x.bands {
+		x.bands[b] = make(map[uint32][]int64)
+	}
+	return x
+}
+
+// hashBand is the b-th 16 bits of the hash, as uint32 since maps with those
+// keys take the fast path.
+func hashBand(hash int64, b int) uint32 {
+	return uint32(uint64(hash)>>(16*b)) & 0xFFFF
+}
+
+func (x *bandIndex) add(itemId int, hash int64) {
+	if slices.Contains(x.hashes[itemId], hash) {
+		return
+	}
+	x.hashes[itemId] = append(x.hashes[itemId], hash)
+
+	if _, ok := x.items[hash]; !ok {
+		for b := range x.bands {
+			v := hashBand(hash, b)
+			x.bands[b][v] = append(x.bands[b][v], hash)
+		}
+	}
+	x.items[hash] = append(x.items[hash], itemId)
+}
+
+func (x *bandIndex) remove(itemId int) {
+	hashes, ok := x.hashes[itemId]
+	if !ok {
+		return
+	}
+	delete(x.hashes, itemId)
+
+	for _, hash := range hashes {
+		ids := slices.DeleteFunc(x.items[hash], func(id int) bool { return id == itemId })
+		if len(ids) > 0 {
+			x.items[hash] = ids
+			continue
+		}
+		delete(x.items, hash)
+		for b := range x.bands {
+			v := hashBand(hash, b)
+			rest := slices.DeleteFunc(x.bands[b][v], func(h int64) bool { return h == hash })
+			if len(rest) == 0 {
+				delete(x.bands[b], v)
+			} else {
+				x.bands[b][v] = rest
+			}
+		}
+	}
+}
+
+func (x *bandIndex) radius(hash int64, maxDistance int) []fingerprintMatch {
+	matches := []fingerprintMatch{}
+	check := func(h int64) {
+		if d := hammingDistance(h, hash); d <= maxDistance {
+			for _, id := range x.items[h] {
+				matches = append(matches, fingerprintMatch{ItemId: id, Distance: d})
+			}
+		}
+	}
+
+	bandDistance := maxDistance / hashBands
+	if bandDistance > maxBandProbeDistance {
+		for h := range x.items {
+			check(h)
+		}
+		return closestMatches(matches)
+	}
+
+	for b := range x.bands {
+		forEachBandNeighbour(hashBand(hash, b), bandDistance, func(v uint32) {
+			for _, h := range x.bands[b][v] {
+				if !nearInEarlierBand(h, hash, b, bandDistance) {
+					check(h)
+				}
+			}
+		})
+	}
+	return closestMatches(matches)
+}
+
+// nearest widens the radius step by step; once k items are within it, no
+// item outside can be any closer.
+func (x *bandIndex) nearest(hash int64, k int, maxDistance int) []fingerprintMatch {
+	r := min(hashBands-1, maxDistance)
+	for {
+		matches := x.radius(hash, r)
+		if len(matches) >= k || r >= maxDistance {
+			sortMatches(matches)
+			if len(matches) > k {
+				matches = matches[:k]
+			}
+			return matches
+		}
+		r += hashBands
+		if r/hashBands > maxBandProbeDistance {
+			r = maxDistance
+		}
+		r = min(r, maxDistance)
+	}
+}
+
+// nearInEarlierBand tells whether h was already found through one of the
+// bands before b.
+func nearInEarlierBand(h int64, hash int64, b int, bandDistance int) bool {
+	for e := range b {
+		if bits.OnesCount32(hashBand(h, e)^hashBand(hash, e)) <= bandDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachBandNeighbour calls fn with every band value within distance of v,
+// v included.
+func forEachBandNeighbour(v uint32, distance int, fn func(uint32)) {
+	fn(v)
+	var flip func(v uint32, from int, left int)
+	flip = func(v uint32, from int, left int) {
+		for bit := from; bit < 16; bit++ {
+			n := v ^ 1<<bit
+			fn(n)
+			if left > 1 {
+				flip(n, bit+1, left-1)
+			}
+		}
+	}
+	if distance > 0 {
+		flip(v, 0, distance)
+	}
+}
+
+// warmFingerprintIndex loads the stored fingerprints of all items and their
+// photos into the index.
+func (c DBService) warmFingerprintIndex() error {
+	result, err := c.DB.Query(`
+		SELECT f.item_id, i.catalog_id, f.algorithm, f.version, f.hash
+		FROM item_fingerprints f
+		INNER JOIN items i ON i.id = f.item_id
+		WHERE i.catalog_id IS NOT NULL AND i.deleted_at IS NULL
+		UNION ALL
+		SELECT ip.item_id, i.catalog_id, f.algorithm, f.version, f.hash
+		FROM photo_fingerprints f
+		INNER JOIN item_photos ip ON ip.photo_id = f.photo_id
+		INNER JOIN items i ON i.id = ip.item_id
+		WHERE i.catalog_id IS NOT NULL AND i.deleted_at IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("warmFingerprintIndex query: %w", err)
+	}
+	defer result.Close()
+
+	count := 0
+	for result.Next() {
+		var itemId, catalogId int
+		var kind hashKind
+		var fingerprint int64
+		if err := result.Scan(&itemId, &catalogId, &kind.Algorithm, &kind.Version, &fingerprint); err != nil {
+			return fmt.Errorf("warmFingerprintIndex scan: %w", err)
+		}
+		c.Index.Add(catalogId, itemId, kind, fingerprint)
+		count++
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("warmFingerprintIndex rows: %w", err)
+	}
+
+	log.Printf("Fingerprint index warmed with %d fingerprints", count)
+	return nil
+}
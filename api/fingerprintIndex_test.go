@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+var testKind = hashKind{Algorithm: "dhash", Version: 2}
+
+// randomFingerprints makes hashes of items in clusters of near duplicates, so
+// that radius queries have something to find. Some items get a second hash,
+// as items with several photos do.
+func randomFingerprints(r *rand.Rand, items int) map[int][]int64 {
+	fingerprints := make(map[int][]int64, items)
+	var base int64
+	for id := 1; id <= items; id++ {
+		if id%8 == 1 {
+			base = int64(r.Uint64())
+		}
+		hash := base
+		for range r.IntN(6) {
+			hash ^= 1 << r.IntN(HashBits)
+		}
+		fingerprints[id] = []int64{hash}
+		if id%5 == 0 {
+			fingerprints[id] = append(fingerprints[id], int64(r.Uint64()))
+		}
+	}
+	return fingerprints
+}
+
+func indexOf(catalogId int, fingerprints map[int][]int64) *FingerprintIndex {
+	x := NewFingerprintIndex()
+	for id, hashes := range fingerprints {
+		for _, hash := range hashes {
+			x.Add(catalogId, id, testKind, hash)
+		}
+	}
+	return x
+}
+
+// bruteForce is what the index must agree with: every item within
+// maxDistance by its closest hash, closest first.
+func bruteForce(fingerprints map[int][]int64, hash int64, maxDistance int) []fingerprintMatch {
+	matches := []fingerprintMatch{}
+	for id, hashes := range fingerprints {
+		if d := closestDistance(hashes, hash); d <= maxDistance {
+			matches = append(matches, fingerprintMatch{ItemId: id, Distance: d})
+		}
+	}
+	sortMatches(matches)
+	return matches
+}
+
+func bruteForceNearest(fingerprints map[int][]int64, hash int64, k int, maxDistance int) []fingerprintMatch {
+	matches := bruteForce(fingerprints, hash, maxDistance)
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches
+}
+
+// assertMatchesBruteForce runs radius and nearest queries for known and
+// random hashes against both the index and a brute-force scan.
+func assertMatchesBruteForce(t *testing.T, r *rand.Rand, x *FingerprintIndex, fingerprints map[int][]int64) {
+	t.Helper()
+	queries := []int64{}
+	for _, hashes := range fingerprints {
+		queries = append(queries, hashes[0]^1<<r.IntN(HashBits))
+		if len(queries) == 50 {
+			break
+		}
+	}
+	for range 50 {
+		queries = append(queries, int64(r.Uint64()))
+	}
+
+	for _, q := range queries {
+		for _, maxDistance := range []int{0, 4, 10, 20} {
+			want := bruteForce(fingerprints, q, maxDistance)
+			if got := x.Radius(1, testKind, q, maxDistance); !slices.Equal(got, want) {
+				t.Fatalf("Radius(%x, %d) = %v, want %v", q, maxDistance, got, want)
+			}
+			for _, k := range []int{1, 5, 20} {
+				want := bruteForceNearest(fingerprints, q, k, maxDistance)
+				if got := x.Nearest(1, testKind, q, k, maxDistance); !slices.Equal(got, want) {
+					t.Fatalf("Nearest(%x, %d, %d) = %v, want %v", q, k, maxDistance, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFingerprintIndexMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	fingerprints := randomFingerprints(r, 2000)
+	x := indexOf(1, fingerprints)
+
+	assertMatchesBruteForce(t, r, x, fingerprints)
+
+	if got := x.Radius(2, testKind, fingerprints[1][0], HashBits); len(got) != 0 {
+		t.Fatalf("Radius in another catalog = %v, want none", got)
+	}
+	if got := x.Radius(1, hashKind{Algorithm: "dhash", Version: 1}, fingerprints[1][0], HashBits); len(got) != 0 {
+		t.Fatalf("Radius of another kind = %v, want none", got)
+	}
+}
+
+func TestFingerprintIndexRemove(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	fingerprints := randomFingerprints(r, 2000)
+	x := indexOf(1, fingerprints)
+
+	for id := 1; id <= 1500; id += 3 {
+		x.Remove(1, id)
+		delete(fingerprints, id)
+	}
+	assertMatchesBruteForce(t, r, x, fingerprints)
+
+	// Items added back are found again, also by hashes other items still have
+	for id := 1; id <= 50; id += 3 {
+		fingerprints[id] = []int64{int64(r.Uint64()), fingerprints[id+1][0]}
+		for _, hash := range fingerprints[id] {
+			x.Add(1, id, testKind, hash)
+		}
+	}
+	assertMatchesBruteForce(t, r, x, fingerprints)
+
+	for id := range fingerprints {
+		x.Remove(1, id)
+	}
+	index := x.catalogs[1][testKind]
+	if len(index.items) != 0 || len(index.bands[0]) != 0 {
+		t.Fatalf("index not empty after removing all items: %d fingerprints left", len(index.items))
+	}
+}
+
+func TestFingerprintIndexItemMatchesByClosestHash(t *testing.T) {
+	x := NewFingerprintIndex()
+	x.Add(1, 1, testKind, 0b1111)
+	x.Add(1, 1, testKind, 0b0001)
+	x.Add(1, 2, testKind, 0b0011)
+
+	got := x.Radius(1, testKind, 0, HashBits)
+	want := []fingerprintMatch{{ItemId: 1, Distance: 1}, {ItemId: 2, Distance: 2}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Radius = %v, want %v", got, want)
+	}
+}
+
+const benchmarkItems = 100_000
+
+// benchmarkQueries are near duplicates of indexed hashes.
+func benchmarkQueries(r *rand.Rand, fingerprints map[int][]int64) []int64 {
+	queries := make([]int64, 1024)
+	for i := range queries {
+		queries[i] = fingerprints[r.IntN(benchmarkItems)+1][0] ^ 1<<r.IntN(HashBits)
+	}
+	return queries
+}
+
+func benchmarkRadius(b *testing.B, maxDistance int) {
+	r := rand.New(rand.NewPCG(5, 6))
+	fingerprints := randomFingerprints(r, benchmarkItems)
+	x := indexOf(1, fingerprints)
+	queries := benchmarkQueries(r, fingerprints)
+
+	for i := 0; b.Loop(); i++ {
+		x.Radius(1, testKind, queries[i%len(queries)], maxDistance)
+	}
+}
+
+func BenchmarkRadius4(b *testing.B)  { benchmarkRadius(b, 4) }
+func BenchmarkRadius10(b *testing.B) { benchmarkRadius(b, 10) }
+
+func BenchmarkNearest(b *testing.B) {
+	r := rand.New(rand.NewPCG(5, 6))
+	fingerprints := randomFingerprints(r, benchmarkItems)
+	x := indexOf(1, fingerprints)
+	queries := benchmarkQueries(r, fingerprints)
+
+	for i := 0; b.Loop(); i++ {
+		x.Nearest(1, testKind, queries[i%len(queries)], 10, 10)
+	}
+}
+
+// BenchmarkBruteForce scans all hashes laid out in a slice, the fastest the
+// index has to beat.
+func BenchmarkBruteForce(b *testing.B) {
+	r := rand.New(rand.NewPCG(5, 6))
+	fingerprints := randomFingerprints(r, benchmarkItems)
+	queries := benchmarkQueries(r, fingerprints)
+	var itemIds []int
+	var hashes []int64
+	for id, itemHashes := range fingerprints {
+		for _, hash := range itemHashes {
+			itemIds = append(itemIds, id)
+			hashes = append(hashes, hash)
+		}
+	}
+
+	for i := 0; b.Loop(); i++ {
+		q := queries[i%len(queries)]
+		matches := []fingerprintMatch{}
+		for j, hash := range hashes {
+			if d := hammingDistance(hash, q); d <= 10 {
+				matches = append(matches, fingerprintMatch{ItemId: itemIds[j], Distance: d})
+			}
+		}
+		sortMatches(closestMatches(matches))
+	}
+}
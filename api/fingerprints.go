@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	AlgorithmAHash = "ahash"
+	AlgorithmDHash = "dhash"
+	AlgorithmPHash = "phash"
+)
+
+var errInvalidFingerprint = errors.New("invalid fingerprint")
+
+// browserDHashVersion is the version of dHash computed by the web client,
+// which only looks at the red channel of a canvas-resampled image.
+const browserDHashVersion = 1
+
+type hashFunc func(image.Image) (int64, error)
+
+type hashAlgorithm struct {
+	Version int
+	Compute hashFunc
+}
+
+// hashAlgorithms are the fingerprints computed by the server. Bump the
+// version whenever an implementation changes in a way that makes its hashes
+// incomparable with the stored ones.
+var hashAlgorithms = map[string]hashAlgorithm{
+	AlgorithmAHash: {Version: 1, Compute: computeAHash},
+	AlgorithmDHash: {Version: 2, Compute: computeDHash},
+	AlgorithmPHash: {Version: 1, Compute: computePHash},
+}
+
+// defaultHashWeights tell how much each algorithm counts when several are
+// combined in a similarity search.
+var defaultHashWeights = map[string]float64{
+	AlgorithmAHash: 0.5,
+	AlgorithmDHash: 1,
+	AlgorithmPHash: 1,
+}
+
+type Fingerprint struct {
+	Algorithm string `json:"algorithm"`
+	Version   int    `json:"version"`
+	Hash      string `json:"hash"`
+}
+
+// hashKind identifies hashes that can be compared with each other.
+type hashKind struct {
+	Algorithm string
+	Version   int
+}
+
+func (f Fingerprint) kind() hashKind {
+	return hashKind{Algorithm: f.Algorithm, Version: f.Version}
+}
+
+// computeFingerprints runs every server-side hash algorithm over the image.
+func computeFingerprints(img image.Image) ([]Fingerprint, error) {
+	fingerprints := []Fingerprint{}
+	for _, name := range []string{AlgorithmAHash, AlgorithmDHash, AlgorithmPHash} {
+		algorithm := hashAlgorithms[name]
+		hash, err := algorithm.Compute(img)
+		if err != nil {
+			return []Fingerprint{}, err
+		}
+		fingerprints = append(fingerprints, Fingerprint{Algorithm: name, Version: algorithm.Version, Hash: fingerprintToHex(hash)})
+	}
+	return fingerprints, nil
+}
+
+// fingerprintsForPayload lists the fingerprints to store for a new or updated
+// item. A bare legacy fingerprint is taken to be the browser's dHash. Typed
+// fingerprints must be of the version the server computes, or the browser's
+// dHash, so that only comparable hashes share an index, and each version of
+// an algorithm may be given once.
+func fingerprintsForPayload(fingerprint string, fingerprints []Fingerprint) ([]Fingerprint, error) {
+	result := []Fingerprint{}
+	seen := map[hashKind]bool{}
+	for _, f := range fingerprints {
+		algorithm, ok := hashAlgorithms[f.Algorithm]
+		if !ok {
+			return []Fingerprint{}, fmt.Errorf("unknown fingerprint algorithm %s: %w", f.Algorithm, errInvalidFingerprint)
+		}
+		browserDHash := f.Algorithm == AlgorithmDHash && f.Version == browserDHashVersion
+		if f.Version != algorithm.Version && !browserDHash {
+			return []Fingerprint{}, fmt.Errorf("%s fingerprint must be of version %d: %w", f.Algorithm, algorithm.Version, errInvalidFingerprint)
+		}
+		if _, err := binaryToBigInt(f.Hash); err != nil {
+			return []Fingerprint{}, fmt.Errorf("%s fingerprint: %v: %w", f.Algorithm, err, errInvalidFingerprint)
+		}
+		if seen[f.kind()] {
+			return []Fingerprint{}, fmt.Errorf("%s fingerprint of version %d is given more than once: %w", f.Algorithm, f.Version, errInvalidFingerprint)
+		}
+		seen[f.kind()] = true
+		result = append(result, f)
+	}
+	if !seen[hashKind{Algorithm: AlgorithmDHash, Version: browserDHashVersion}] && fingerprint != "" {
+		if _, err := binaryToBigInt(fingerprint); err != nil {
+			return []Fingerprint{}, fmt.Errorf("fingerprint: %v: %w", err, errInvalidFingerprint)
+		}
+		result = append(result, Fingerprint{Algorithm: AlgorithmDHash, Version: browserDHashVersion, Hash: fingerprint})
+	}
+	return result, nil
+}
+
+// legacyFingerprint gives the values of the items.fingerprint and
+// fingerprint_bigint columns, which hold the browser's dHash only. Items
+// without one, like those hashed by the server, get an empty fingerprint and
+// a NULL fingerprint_bigint.
+func legacyFingerprint(fingerprints []Fingerprint) (string, sql.NullInt64, error) {
+	for _, f := range fingerprints {
+		if f.Algorithm != AlgorithmDHash || f.Version != browserDHashVersion {
+			continue
+		}
+		hash, err := binaryToBigInt(f.Hash)
+		if err != nil {
+			return "", sql.NullInt64{}, err
+		}
+		return f.Hash, sql.NullInt64{Int64: hash, Valid: true}, nil
+	}
+	return "", sql.NullInt64{}, nil
+}
+
+// parseHashWeights reads weights like "dhash:1,phash:0.5" on top of the defaults.
+func parseHashWeights(raw string) (map[string]float64, error) {
+	weights := make(map[string]float64, len(defaultHashWeights))
+	for k, v := range defaultHashWeights {
+		weights[k] = v
+	}
+	if raw == "" {
+		return weights, nil
+	}
+
+	for _, part := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("weight %q must look like algorithm:weight", part)
+		}
+		if _, known := hashAlgorithms[name]; !known {
+			return nil, fmt.Errorf("unknown fingerprint algorithm %s", name)
+		}
+		w, err := strconv.ParseFloat(value, 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("weight of %s must be a non-negative number", name)
+		}
+		weights[name] = w
+	}
+	return weights, nil
+}
+
+// queriesForFingerprints turns fingerprints into weighted index queries.
+func queriesForFingerprints(fingerprints []Fingerprint, weights map[string]float64) ([]fingerprintQuery, error) {
+	queries := make([]fingerprintQuery, 0, len(fingerprints))
+	for _, f := range fingerprints {
+		hash, err := binaryToBigInt(f.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s fingerprint must be 16 hex characters", f.Algorithm)
+		}
+		queries = append(queries, fingerprintQuery{Kind: f.kind(), Hash: hash, Weight: weights[f.Algorithm]})
+	}
+	return queries, nil
+}
+
+// storeFingerprints replaces the stored fingerprints of the item.
+func storeFingerprints(ctx context.Context, tx *sql.Tx, itemId int64, fingerprints []Fingerprint) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_fingerprints WHERE item_id = $1", itemId); err != nil {
+		return fmt.Errorf("storeFingerprints delete: %w", err)
+	}
+	for _, f := range fingerprints {
+		hash, err := binaryToBigInt(f.Hash)
+		if err != nil {
+			return fmt.Errorf("storeFingerprints: %w", err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO item_fingerprints(item_id, algorithm, version, hash) VALUES ($1, $2, $3, $4)",
+			itemId, f.Algorithm, f.Version, hash)
+		if err != nil {
+			return fmt.Errorf("storeFingerprints insert: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexFingerprints puts the item's fingerprints, along with the ones of all
+// its photos, into the index, dropping the ones it had before.
+func (c DBService) indexFingerprints(catalogId int, itemId int, fingerprints []Fingerprint) {
+	photoFingerprints, err := c.itemPhotoFingerprints(itemId)
+	if err != nil {
+		log.Printf("Error indexing photos of item %d: %s", itemId, err)
+	}
+
+	c.Index.Remove(catalogId, itemId)
+	for _, f := range slices.Concat(fingerprints, photoFingerprints) {
+		hash, err := binaryToBigInt(f.Hash)
+		if err != nil {
+			continue
+		}
+		c.Index.Add(catalogId, itemId, f.kind(), hash)
+	}
+}
+
+// attachFingerprints loads the stored fingerprints of the given items.
+func (c DBService) attachFingerprints(items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(items))
+	byId := make(map[int]*Item, len(items))
+	for i := range items {
+		ids[i] = items[i].Id
+		items[i].Fingerprints = []Fingerprint{}
+		byId[items[i].Id] = &items[i]
+	}
+
+	result, err := c.DB.Query(`
+		SELECT item_id, algorithm, version, hash
+		FROM item_fingerprints
+		WHERE item_id = ANY($1)
+		ORDER BY item_id, algorithm
+	`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("attachFingerprints query: %w", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var itemId int
+		var f Fingerprint
+		var hash int64
+		if err := result.Scan(&itemId, &f.Algorithm, &f.Version, &hash); err != nil {
+			return fmt.Errorf("attachFingerprints scan: %w", err)
+		}
+		f.Hash = fingerprintToHex(hash)
+		if item, ok := byId[itemId]; ok {
+			item.Fingerprints = append(item.Fingerprints, f)
+		}
+	}
+	return result.Err()
+}
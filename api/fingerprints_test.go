@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"slices"
+	"testing"
+)
+
+func TestFingerprintsForPayloadTakesBothDHashVersions(t *testing.T) {
+	browser := Fingerprint{Algorithm: AlgorithmDHash, Version: browserDHashVersion, Hash: fingerprintToHex(1)}
+	server := Fingerprint{Algorithm: AlgorithmDHash, Version: hashAlgorithms[AlgorithmDHash].Version, Hash: fingerprintToHex(2)}
+
+	got, err := fingerprintsForPayload("", []Fingerprint{browser, server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Fingerprint{browser, server}; !slices.Equal(got, want) {
+		t.Fatalf("fingerprints = %v, want %v", got, want)
+	}
+
+	// A bare fingerprint is the browser's dHash, which the server's doesn't stand in for
+	got, err = fingerprintsForPayload(fingerprintToHex(3), []Fingerprint{server})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Fingerprint{server, {Algorithm: AlgorithmDHash, Version: browserDHashVersion, Hash: fingerprintToHex(3)}}; !slices.Equal(got, want) {
+		t.Fatalf("fingerprints = %v, want %v", got, want)
+	}
+}
+
+func TestFingerprintsForPayloadRejectsRepeatedVersion(t *testing.T) {
+	server := Fingerprint{Algorithm: AlgorithmDHash, Version: hashAlgorithms[AlgorithmDHash].Version, Hash: fingerprintToHex(2)}
+	other := server
+	other.Hash = fingerprintToHex(4)
+	if _, err := fingerprintsForPayload("", []Fingerprint{server, other}); !errors.Is(err, errInvalidFingerprint) {
+		t.Fatalf("repeated dhash fingerprint gave %v, want errInvalidFingerprint", err)
+	}
+	if _, err := fingerprintsForPayload("abc", nil); !errors.Is(err, errInvalidFingerprint) {
+		t.Fatalf("short legacy fingerprint gave %v, want errInvalidFingerprint", err)
+	}
+}
+
+func TestLegacyFingerprintIsBrowserDHashOnly(t *testing.T) {
+	server, err := computeFingerprints(image.NewGray(image.Rect(0, 0, 32, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, bigint, err := legacyFingerprint(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != "" || bigint.Valid {
+		t.Fatalf("server fingerprints gave legacy fingerprint %q (%v)", fingerprint, bigint)
+	}
+
+	browser := Fingerprint{Algorithm: AlgorithmDHash, Version: browserDHashVersion, Hash: fingerprintToHex(5)}
+	fingerprint, bigint, err = legacyFingerprint(append(server, browser))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != browser.Hash || !bigint.Valid || bigint.Int64 != 5 {
+		t.Fatalf("legacy fingerprint = %q (%v), want %q", fingerprint, bigint, browser.Hash)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"sort"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	maxImageUploadBytes = 20 << 20
+	// maxImagePixels bounds what images decode to, as a small file can
+	// declare huge dimensions.
+	maxImagePixels = 40_000_000
+)
+
+var errImageTooLarge = errors.New("image is larger than 40 megapixels")
+
+// decodeImage decodes a JPEG, PNG or WebP image, reading its dimensions first
+// to refuse images over maxImagePixels before any pixels are allocated. JPEG
+// images are turned upright as their EXIF orientation says, so fingerprints
+// and photo variants are made of what the browser shows.
+func decodeImage(r io.Reader) (image.Image, error) {
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, fmt.Errorf("decodeImage: %w", err)
+	}
+	if config.Width > maxImagePixels || config.Height > maxImagePixels || config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("decodeImage %dx%d: %w", config.Width, config.Height, errImageTooLarge)
+	}
+
+	// The EXIF segment comes before the frame header, so reading the
+	// dimensions went past it
+	orientation := jpegOrientation(header.Bytes())
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, fmt.Errorf("decodeImage: %w", err)
+	}
+	return applyOrientation(img, orientation), nil
+}
+
+// computeDHash calculates the difference hash of the image: it is shrunk to
+// HashWidth x HashHeight luminance values and every bit tells whether a pixel
+// is at least as bright as its right neighbour, row by row, most significant
+// bit first. This matches the bit layout of fingerprints made by the browser.
+func computeDHash(img image.Image) (int64, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0, fmt.Errorf("computeDHash: image is empty")
+	}
+	gray := shrinkLuminance(img, HashWidth, HashHeight)
+
+	var hash uint64
+	for y := 0; y < HashHeight; y++ {
+		for x := 0; x < HashWidth-1; x++ {
+			hash <<= 1
+			if gray[y*HashWidth+x] >= gray[y*HashWidth+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return int64(hash), nil
+}
+
+// computeAHash calculates the average hash of the image: it is shrunk to 8x8
+// luminance values and every bit tells whether a pixel is at least as bright
+// as the mean.
+func computeAHash(img image.Image) (int64, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0, fmt.Errorf("computeAHash: image is empty")
+	}
+	gray := shrinkLuminance(img, 8, 8)
+
+	var mean float64
+	for _, v := range gray {
+		mean += v
+	}
+	mean /= float64(len(gray))
+
+	var hash uint64
+	for _, v := range gray {
+		hash <<= 1
+		if v >= mean {
+			hash |= 1
+		}
+	}
+	return int64(hash), nil
+}
+
+const pHashSize = 32
+
+// computePHash calculates the perceptual hash of the image: the 8x8 lowest
+// frequencies of a DCT over 32x32 luminance values, where every bit tells
+// whether a coefficient is above the median. The DC term is left out of the
+// median as it only carries overall brightness.
+func computePHash(img image.Image) (int64, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0, fmt.Errorf("computePHash: image is empty")
+	}
+	gray := shrinkLuminance(img, pHashSize, pHashSize)
+	coeffs := dct2D(gray, pHashSize)
+
+	low := make([]float64, 0, 64)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			low = append(low, coeffs[y*pHashSize+x])
+		}
+	}
+	sorted := append([]float64(nil), low[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, v := range low {
+		hash <<= 1
+		if v > median {
+			hash |= 1
+		}
+	}
+	return int64(hash), nil
+}
+
+// dct2D runs an unnormalised DCT-II over rows and then columns of a square
+// row-major buffer.
+func dct2D(src []float64, n int) []float64 {
+	cos := make([]float64, n*n)
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			cos[k*n+i] = math.Cos(math.Pi / float64(n) * (float64(i) + 0.5) * float64(k))
+		}
+	}
+
+	rows := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for k := 0; k < n; k++ {
+			var v float64
+			for i := 0; i < n; i++ {
+				v += float64(src[y*n+i] * cos[k*n+i])
+			}
+			rows[y*n+k] = v
+		}
+	}
+
+	out := make([]float64, n*n)
+	for x := 0; x < n; x++ {
+		for k := 0; k < n; k++ {
+			var v float64
+			for i := 0; i < n; i++ {
+				v += float64(rows[i*n+x] * cos[k*n+i])
+			}
+			out[k*n+x] = v
+		}
+	}
+	return out
+}
+
+// fingerprintToHex formats a 64-bit fingerprint the way clients send it.
+func fingerprintToHex(fingerprint int64) string {
+	return fmt.Sprintf("%016x", uint64(fingerprint))
+}
+
+// luminanceRow converts row y of the image to Rec. 601 luma values in the
+// 0-255 range. Common image types are read directly rather than through At,
+// with the same colour conversion.
+func luminanceRow(img image.Image, y int, out []float64) {
+	b := img.Bounds()
+	luma := func(i int, r, g, bl uint32) {
+		out[i] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+	}
+	switch m := img.(type) {
+	case *image.YCbCr:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := m.YCbCrAt(x, y).RGBA()
+			luma(x-b.Min.X, r, g, bl)
+		}
+	case *image.NRGBA:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := m.NRGBAAt(x, y).RGBA()
+			luma(x-b.Min.X, r, g, bl)
+		}
+	case *image.RGBA:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := m.RGBAAt(x, y).RGBA()
+			luma(x-b.Min.X, r, g, bl)
+		}
+	case *image.Gray:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := m.GrayAt(x, y).RGBA()
+			luma(x-b.Min.X, r, g, bl)
+		}
+	default:
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			luma(x-b.Min.X, r, g, bl)
+		}
+	}
+}
+
+type areaWeight struct {
+	index  int
+	weight float64
+}
+
+// areaWeights lists, for every destination cell, the source cells it covers
+// and how much of each, so that resizing is a plain area average that doesn't
+// depend on any platform's resampling.
+func areaWeights(srcSize, dstSize int) [][]areaWeight {
+	scale := float64(srcSize) / float64(dstSize)
+	weights := make([][]areaWeight, dstSize)
+	for d := 0; d < dstSize; d++ {
+		start := float64(d) * scale
+		end := start + scale
+		for s := int(start); s < srcSize && float64(s) < end; s++ {
+			w := min(end, float64(s+1)) - max(start, float64(s))
+			if w > 0 {
+				weights[d] = append(weights[d], areaWeight{index: s, weight: w / scale})
+			}
+		}
+	}
+	return weights
+}
+
+// shrinkLuminance area-averages the luma of the image down to dstW x dstH,
+// row-major. Rows are converted one at a time, so only the horizontally
+// shrunk rows are held rather than the whole image. Products are converted
+// explicitly so the compiler can't fuse them into multiply-adds, which would
+// make results differ between architectures.
+func shrinkLuminance(img image.Image, dstW, dstH int) []float64 {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	xWeights := areaWeights(srcW, dstW)
+	yWeights := areaWeights(srcH, dstH)
+
+	// horizontal pass: srcH rows of dstW values
+	row := make([]float64, srcW)
+	rows := make([]float64, srcH*dstW)
+	for y := 0; y < srcH; y++ {
+		luminanceRow(img, b.Min.Y+y, row)
+		for x, ws := range xWeights {
+			var v float64
+			for _, w := range ws {
+				v += float64(row[w.index] * w.weight)
+			}
+			rows[y*dstW+x] = v
+		}
+	}
+
+	// vertical pass
+	out := make([]float64, dstW*dstH)
+	for y, ws := range yWeights {
+		for x := 0; x < dstW; x++ {
+			var v float64
+			for _, w := range ws {
+				v += float64(rows[w.index*dstW+x] * w.weight)
+			}
+			out[y*dstW+x] = v
+		}
+	}
+	return out
+}
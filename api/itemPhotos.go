@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var errInvalidPhotoOrder = errors.New("order must list every photo of the item once")
+
+// ItemPhoto is one of the photos of an item, in the item's order. The
+// primary photo is the one the item shows as photoUrl.
+type ItemPhoto struct {
+	Id           int               `json:"id"`
+	Position     int               `json:"position"`
+	Primary      bool              `json:"primary"`
+	Url          string            `json:"url"`
+	Variants     *PhotoVariantUrls `json:"variants"`
+	Fingerprints []Fingerprint     `json:"fingerprints"`
+	CreatedAt    time.Time         `json:"createdAt"`
+}
+
+// PatchItemPhotosPayload reorders the photos of an item and picks its
+// primary photo; nil fields are left as they are.
+type PatchItemPhotosPayload struct {
+	// Order lists the ids of all photos of the item in their new order.
+	Order     []int `json:"order"`
+	PrimaryId *int  `json:"primaryId"`
+}
+
+// lockItemForPhotos locks the item and returns its primary photo.
+func lockItemForPhotos(ctx context.Context, tx *sql.Tx, itemId int, catalogId int) (sql.NullInt64, error) {
+	var primaryId sql.NullInt64
+	err := tx.QueryRowContext(ctx, "SELECT photo_id FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL FOR UPDATE", itemId, catalogId).Scan(&primaryId)
+	if err == sql.ErrNoRows {
+		return primaryId, fmt.Errorf("item %d: %w", itemId, errItemNotFound)
+	}
+	if err != nil {
+		return primaryId, fmt.Errorf("lockItemForPhotos: %w", err)
+	}
+	return primaryId, nil
+}
+
+func storePhotoFingerprints(ctx context.Context, tx *sql.Tx, photoId int, fingerprints []Fingerprint) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photo_fingerprints WHERE photo_id = $1", photoId); err != nil {
+		return fmt.Errorf("storePhotoFingerprints delete: %w", err)
+	}
+	for _, f := range fingerprints {
+		hash, err := binaryToBigInt(f.Hash)
+		if err != nil {
+			return fmt.Errorf("storePhotoFingerprints: %w", err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO photo_fingerprints(photo_id, algorithm, version, hash) VALUES ($1, $2, $3, $4)",
+			photoId, f.Algorithm, f.Version, hash)
+		if err != nil {
+			return fmt.Errorf("storePhotoFingerprints insert: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadPhotoFingerprints reads the stored fingerprints of a photo.
+func loadPhotoFingerprints(ctx context.Context, tx *sql.Tx, photoId int) ([]Fingerprint, error) {
+	result, err := tx.QueryContext(ctx, "SELECT algorithm, version, hash FROM photo_fingerprints WHERE photo_id = $1 ORDER BY algorithm", photoId)
+	if err != nil {
+		return nil, fmt.Errorf("loadPhotoFingerprints query: %w", err)
+	}
+	defer result.Close()
+	return scanFingerprints(result)
+}
+
+func scanFingerprints(result *sql.Rows) ([]Fingerprint, error) {
+	fingerprints := []Fingerprint{}
+	for result.Next() {
+		var f Fingerprint
+		var hash int64
+		if err := result.Scan(&f.Algorithm, &f.Version, &hash); err != nil {
+			return nil, fmt.Errorf("scanFingerprints: %w", err)
+		}
+		f.Hash = fingerprintToHex(hash)
+		fingerprints = append(fingerprints, f)
+	}
+	return fingerprints, result.Err()
+}
+
+// itemPhotoFingerprints reads the fingerprints of all photos of the item.
+func (c DBService) itemPhotoFingerprints(itemId int) ([]Fingerprint, error) {
+	result, err := c.DB.Query(`
+		SELECT f.algorithm, f.version, f.hash
+		FROM photo_fingerprints f
+		INNER JOIN item_photos ip ON ip.photo_id = f.photo_id
+		WHERE ip.item_id = $1
+	`, itemId)
+	if err != nil {
+		return nil, fmt.Errorf("itemPhotoFingerprints query: %w", err)
+	}
+	defer result.Close()
+	return scanFingerprints(result)
+}
+
+// reindexItem puts the stored fingerprints of the item and its photos into
+// the index again.
+func (c DBService) reindexItem(catalogId int, itemId int) {
+	item, err := c.GetItem(itemId, catalogId)
+	if err != nil {
+		log.Printf("Error reindexing item %d: %s", itemId, err)
+		return
+	}
+	c.indexFingerprints(catalogId, itemId, item.Fingerprints)
+}
+
+// makePrimaryPhoto shows the photo as the item's photo, taking over its
+// fingerprints as the item's.
+func makePrimaryPhoto(ctx context.Context, tx *sql.Tx, itemId int, photoId int) error {
+	fingerprints, err := loadPhotoFingerprints(ctx, tx, photoId)
+	if err != nil {
+		return err
+	}
+	url := photoUrl(photoId)
+	if _, err := updateItemFields(ctx, tx, itemId, PatchItemPayload{PhotoUrl: &url, Fingerprints: fingerprints}, nil); err != nil {
+		return fmt.Errorf("makePrimaryPhoto: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET photo_id = $1 WHERE id = $2", photoId, itemId); err != nil {
+		return fmt.Errorf("makePrimaryPhoto: %w", err)
+	}
+	return nil
+}
+
+// clearItemPhoto leaves the item without a photo.
+func clearItemPhoto(ctx context.Context, tx *sql.Tx, itemId int) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE items SET photo_id = NULL, photo_url = '', fingerprint = '', fingerprint_bigint = NULL, updated_at = now()
+		WHERE id = $1
+	`, itemId)
+	if err != nil {
+		return fmt.Errorf("clearItemPhoto: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_fingerprints WHERE item_id = $1", itemId); err != nil {
+		return fmt.Errorf("clearItemPhoto fingerprints: %w", err)
+	}
+	return nil
+}
+
+// removeItemPhoto deletes a photo the item no longer shows and returns the
+// key of its blob, to be deleted once the transaction commits.
+func removeItemPhoto(ctx context.Context, tx *sql.Tx, itemId int, photoId int) (string, error) {
+	result, err := tx.ExecContext(ctx, "DELETE FROM item_photos WHERE item_id = $1 AND photo_id = $2", itemId, photoId)
+	if err != nil {
+		return "", fmt.Errorf("removeItemPhoto: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return "", fmt.Errorf("removeItemPhoto %d: %w", photoId, errPhotoNotFound)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photo_fingerprints WHERE photo_id = $1", photoId); err != nil {
+		return "", fmt.Errorf("removeItemPhoto fingerprints: %w", err)
+	}
+	var key string
+	if err := tx.QueryRowContext(ctx, "DELETE FROM photos WHERE id = $1 RETURNING blob_key", photoId).Scan(&key); err != nil {
+		return "", fmt.Errorf("removeItemPhoto photo: %w", err)
+	}
+
+	// Close the gap in the order
+	_, err = tx.ExecContext(ctx, `
+		UPDATE item_photos ip SET position = o.n
+		FROM (
+			SELECT photo_id, row_number() OVER (ORDER BY position, photo_id) - 1 AS n
+			FROM item_photos WHERE item_id = $1
+		) o
+		WHERE ip.photo_id = o.photo_id
+	`, itemId)
+	if err != nil {
+		return "", fmt.Errorf("removeItemPhoto renumber: %w", err)
+	}
+	return key, nil
+}
+
+// GetItemPhotos lists the photos of an item of the catalog in their order.
+func (c DBService) GetItemPhotos(itemId int, catalogId int, ctx context.Context) ([]ItemPhoto, error) {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("GetItemPhotos begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var primaryId sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT photo_id FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL", itemId, catalogId).Scan(&primaryId)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("GetItemPhotos %d: %w", itemId, errItemNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetItemPhotos verify item: %w", err)
+	}
+
+	result, err := tx.QueryContext(ctx, `
+		SELECT p.id, ip.position, p.created_at
+		FROM item_photos ip
+		INNER JOIN photos p ON p.id = ip.photo_id
+		WHERE ip.item_id = $1
+		ORDER BY ip.position, p.id
+	`, itemId)
+	if err != nil {
+		return nil, fmt.Errorf("GetItemPhotos query: %w", err)
+	}
+	photos := []ItemPhoto{}
+	for result.Next() {
+		var p ItemPhoto
+		if err := result.Scan(&p.Id, &p.Position, &p.CreatedAt); err != nil {
+			result.Close()
+			return nil, fmt.Errorf("GetItemPhotos scan: %w", err)
+		}
+		p.Primary = primaryId.Valid && int(primaryId.Int64) == p.Id
+		p.Url = photoUrl(p.Id)
+		p.Variants = photoVariantUrls(p.Id)
+		photos = append(photos, p)
+	}
+	result.Close()
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("GetItemPhotos rows: %w", err)
+	}
+
+	for i := range photos {
+		if photos[i].Fingerprints, err = loadPhotoFingerprints(ctx, tx, photos[i].Id); err != nil {
+			return nil, fmt.Errorf("GetItemPhotos: %w", err)
+		}
+	}
+	return photos, nil
+}
+
+// AddItemPhoto stores the image as the last photo of the item. It becomes
+// the primary photo when asked to or when the item has no stored photo yet.
+func (c DBService) AddItemPhoto(itemId int, catalogId int, upload photoUpload, primary bool, ctx context.Context) (Photo, error) {
+	return c.addItemPhoto(itemId, catalogId, upload, primary, false, ctx)
+}
+
+// SetItemPhoto stores the image as the item's primary photo in place of the
+// one it had, which is deleted.
+func (c DBService) SetItemPhoto(itemId int, catalogId int, upload photoUpload, ctx context.Context) (Photo, error) {
+	return c.addItemPhoto(itemId, catalogId, upload, true, true, ctx)
+}
+
+func (c DBService) addItemPhoto(itemId int, catalogId int, upload photoUpload, primary bool, replace bool, ctx context.Context) (Photo, error) {
+	key, err := newPhotoBlobKey(catalogId)
+	if err != nil {
+		return Photo{}, err
+	}
+	if err := c.Blobs.Put(ctx, key, upload.Data, upload.ContentType); err != nil {
+		return Photo{}, fmt.Errorf("addItemPhoto: %w", err)
+	}
+	if err := c.storePhotoVariants(ctx, key, upload.Image); err != nil {
+		c.discardPhotoBlobs(key)
+		return Photo{}, fmt.Errorf("addItemPhoto: %w", err)
+	}
+
+	photo, replacedKey, err := c.insertItemPhoto(itemId, catalogId, key, upload, primary, replace, ctx)
+	if err != nil {
+		// Nothing points at the blobs yet
+		c.discardPhotoBlobs(key)
+		return Photo{}, err
+	}
+	if replacedKey != "" {
+		c.discardPhotoBlobs(replacedKey)
+	}
+	c.reindexItem(catalogId, itemId)
+	return photo, nil
+}
+
+// insertItemPhoto records the stored blob as a photo of the item, returning
+// the blob key of the primary photo it replaced, if any.
+func (c DBService) insertItemPhoto(itemId int, catalogId int, key string, upload photoUpload, primary bool, replace bool, ctx context.Context) (Photo, string, error) {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return Photo{}, "", fmt.Errorf("insertItemPhoto begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	primaryId, err := lockItemForPhotos(ctx, tx, itemId, catalogId)
+	if err != nil {
+		return Photo{}, "", err
+	}
+
+	photo := Photo{CatalogId: catalogId, BlobKey: key, ContentType: upload.ContentType, Size: len(upload.Data)}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO photos(catalog_id, blob_key, content_type, size)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, catalogId, key, photo.ContentType, photo.Size).Scan(&photo.Id, &photo.CreatedAt)
+	if err != nil {
+		return Photo{}, "", fmt.Errorf("insertItemPhoto insert photo: %w", err)
+	}
+	if err := storePhotoFingerprints(ctx, tx, photo.Id, upload.Fingerprints); err != nil {
+		return Photo{}, "", err
+	}
+
+	// A replacement takes the place of the replaced photo
+	replaced := replace && primaryId.Valid
+	var position int
+	if replaced {
+		err = tx.QueryRowContext(ctx, "SELECT position FROM item_photos WHERE photo_id = $1", primaryId.Int64).Scan(&position)
+	} else {
+		err = tx.QueryRowContext(ctx, "SELECT count(*) FROM item_photos WHERE item_id = $1", itemId).Scan(&position)
+	}
+	if err != nil {
+		return Photo{}, "", fmt.Errorf("insertItemPhoto position: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO item_photos(item_id, photo_id, position) VALUES ($1, $2, $3)", itemId, photo.Id, position); err != nil {
+		return Photo{}, "", fmt.Errorf("insertItemPhoto link: %w", err)
+	}
+
+	if primary || !primaryId.Valid {
+		if err := makePrimaryPhoto(ctx, tx, itemId, photo.Id); err != nil {
+			return Photo{}, "", err
+		}
+	} else if _, err := tx.ExecContext(ctx, "UPDATE items SET updated_at = now() WHERE id = $1", itemId); err != nil {
+		return Photo{}, "", fmt.Errorf("insertItemPhoto updated_at: %w", err)
+	}
+
+	var replacedKey string
+	if replaced {
+		if replacedKey, err = removeItemPhoto(ctx, tx, itemId, int(primaryId.Int64)); err != nil {
+			return Photo{}, "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Photo{}, "", fmt.Errorf("insertItemPhoto commit: %w", err)
+	}
+	return photo, replacedKey, nil
+}
+
+// UpdateItemPhotos reorders the photos of an item of the catalog and picks
+// its primary photo.
+func (c DBService) UpdateItemPhotos(itemId int, catalogId int, payload PatchItemPhotosPayload, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("UpdateItemPhotos begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	primaryId, err := lockItemForPhotos(ctx, tx, itemId, catalogId)
+	if err != nil {
+		return fmt.Errorf("UpdateItemPhotos: %w", err)
+	}
+
+	var photoIds []int64
+	if err := tx.QueryRowContext(ctx, "SELECT coalesce(array_agg(photo_id), '{}') FROM item_photos WHERE item_id = $1", itemId).Scan(pq.Array(&photoIds)); err != nil {
+		return fmt.Errorf("UpdateItemPhotos photos: %w", err)
+	}
+
+	if payload.Order != nil {
+		if len(payload.Order) != len(photoIds) {
+			return errInvalidPhotoOrder
+		}
+		seen := map[int]bool{}
+		for _, id := range payload.Order {
+			if seen[id] || !slices.Contains(photoIds, int64(id)) {
+				return errInvalidPhotoOrder
+			}
+			seen[id] = true
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE item_photos SET position = array_position($2::integer[], photo_id) - 1 WHERE item_id = $1", itemId, pq.Array(payload.Order))
+		if err != nil {
+			return fmt.Errorf("UpdateItemPhotos order: %w", err)
+		}
+	}
+
+	if payload.PrimaryId != nil && (!primaryId.Valid || int(primaryId.Int64) != *payload.PrimaryId) {
+		if !slices.Contains(photoIds, int64(*payload.PrimaryId)) {
+			return fmt.Errorf("UpdateItemPhotos %d: %w", *payload.PrimaryId, errPhotoNotFound)
+		}
+		if err := makePrimaryPhoto(ctx, tx, itemId, *payload.PrimaryId); err != nil {
+			return fmt.Errorf("UpdateItemPhotos: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET updated_at = now() WHERE id = $1", itemId); err != nil {
+		return fmt.Errorf("UpdateItemPhotos updated_at: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateItemPhotos commit: %w", err)
+	}
+	c.reindexItem(catalogId, itemId)
+	return nil
+}
+
+// DeletePhoto removes a photo of the catalog from its item. When it was the
+// primary photo the next one in order takes its place.
+func (c DBService) DeletePhoto(photoId int, catalogId int, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("DeletePhoto begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var itemId int
+	err = tx.QueryRowContext(ctx, `
+		SELECT ip.item_id
+		FROM item_photos ip
+		INNER JOIN photos p ON p.id = ip.photo_id
+		WHERE ip.photo_id = $1 AND p.catalog_id = $2
+	`, photoId, catalogId).Scan(&itemId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("DeletePhoto %d: %w", photoId, errPhotoNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("DeletePhoto find item: %w", err)
+	}
+
+	primaryId, err := lockItemForPhotos(ctx, tx, itemId, catalogId)
+	if err != nil {
+		return fmt.Errorf("DeletePhoto: %w", err)
+	}
+	if primaryId.Valid && int(primaryId.Int64) == photoId {
+		var nextId int
+		err = tx.QueryRowContext(ctx, "SELECT photo_id FROM item_photos WHERE item_id = $1 AND photo_id <> $2 ORDER BY position, photo_id LIMIT 1", itemId, photoId).Scan(&nextId)
+		if err == sql.ErrNoRows {
+			err = clearItemPhoto(ctx, tx, itemId)
+		} else if err == nil {
+			err = makePrimaryPhoto(ctx, tx, itemId, nextId)
+		}
+		if err != nil {
+			return fmt.Errorf("DeletePhoto: %w", err)
+		}
+	}
+
+	key, err := removeItemPhoto(ctx, tx, itemId, photoId)
+	if err != nil {
+		return fmt.Errorf("DeletePhoto: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET updated_at = now() WHERE id = $1", itemId); err != nil {
+		return fmt.Errorf("DeletePhoto updated_at: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("DeletePhoto commit: %w", err)
+	}
+
+	c.discardPhotoBlobs(key)
+	c.reindexItem(catalogId, itemId)
+	return nil
+}
+
+// ReplacePhotoFingerprints stores freshly computed fingerprints of a photo.
+func (c DBService) ReplacePhotoFingerprints(ctx context.Context, photoId int, fingerprints []Fingerprint) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("ReplacePhotoFingerprints begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := storePhotoFingerprints(ctx, tx, photoId, fingerprints); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplacePhotoFingerprints commit: %w", err)
+	}
+	return nil
+}
+
+// getItemPhotoBlobs lists the stored photos of an item.
+func (c DBService) getItemPhotoBlobs(ctx context.Context, itemId int) ([]Photo, error) {
+	result, err := c.DB.QueryContext(ctx, `
+		SELECT p.id, p.blob_key
+		FROM item_photos ip
+		INNER JOIN photos p ON p.id = ip.photo_id
+		WHERE ip.item_id = $1
+		ORDER BY ip.position
+	`, itemId)
+	if err != nil {
+		return nil, fmt.Errorf("getItemPhotoBlobs query: %w", err)
+	}
+	defer result.Close()
+
+	photos := []Photo{}
+	for result.Next() {
+		var p Photo
+		if err := result.Scan(&p.Id, &p.BlobKey); err != nil {
+			return nil, fmt.Errorf("getItemPhotoBlobs scan: %w", err)
+		}
+		photos = append(photos, p)
+	}
+	return photos, result.Err()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	ItemStatusOwned      = "owned"
+	ItemStatusWanted     = "wanted"
+	ItemStatusTradedAway = "traded_away"
+)
+
+var itemStatuses = []string{ItemStatusOwned, ItemStatusWanted, ItemStatusTradedAway}
+
+// similarityMatches tell a scan matching an item apart by the item's status,
+// e.g. a match of a wanted item is something to pick up rather than a copy
+// already owned.
+var similarityMatches = map[string]string{
+	ItemStatusOwned:      "alreadyOwned",
+	ItemStatusWanted:     "wanted",
+	ItemStatusTradedAway: "tradedAway",
+}
+
+var (
+	errItemNotWanted          = errors.New("item is not wanted")
+	errInvalidAcquireQuantity = errors.New("quantity must be at least 1")
+	errInvalidStatus          = errors.New("invalid status")
+)
+
+// AcquireItemPayload turns a wanted item into an owned one. Fingerprints of
+// the acquired copy replace the reference ones when given, its photo is
+// uploaded to /api/items/{id}/photo.
+type AcquireItemPayload struct {
+	// PhotoUrl is only read to be rejected, see photoUrlReadOnly.
+	PhotoUrl     *string       `json:"photoUrl"`
+	Fingerprint  *string       `json:"fingerprint"`
+	Fingerprints []Fingerprint `json:"fingerprints"`
+	// Quantity of copies acquired, 1 when not given.
+	Quantity *int `json:"quantity"`
+}
+
+// AcquireItem marks a wanted item of the catalog as owned.
+func (c DBService) AcquireItem(itemId int, catalogId int, payload AcquireItemPayload, ctx context.Context) error {
+	quantity := 1
+	if payload.Quantity != nil {
+		quantity = *payload.Quantity
+	}
+	if quantity < 1 {
+		return fmt.Errorf("AcquireItem: %w", errInvalidAcquireQuantity)
+	}
+
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("AcquireItem begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL FOR UPDATE", itemId, catalogId).Scan(&status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("AcquireItem %d: %w", itemId, errItemNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("AcquireItem verify item: %w", err)
+	}
+	if status != ItemStatusWanted {
+		return fmt.Errorf("AcquireItem %d is %s: %w", itemId, status, errItemNotWanted)
+	}
+
+	fingerprints, err := updateItemFields(ctx, tx, itemId, PatchItemPayload{
+		Fingerprint:  payload.Fingerprint,
+		Fingerprints: payload.Fingerprints,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("AcquireItem: %w", err)
+	}
+	if err := setItemStatus(ctx, tx, itemId, ItemStatusOwned, &quantity); err != nil {
+		return fmt.Errorf("AcquireItem: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("AcquireItem commit: %w", err)
+	}
+	if fingerprints != nil {
+		c.indexFingerprints(catalogId, itemId, fingerprints)
+	}
+	return nil
+}
+
+// setItemStatus changes the status of a locked item and keeps its quantity in
+// step, recording the change: items that aren't owned have no copies, and an
+// item becoming owned has the given quantity, or one copy.
+func setItemStatus(ctx context.Context, tx *sql.Tx, itemId int, status string, quantity *int) error {
+	if !slices.Contains(itemStatuses, status) {
+		return fmt.Errorf("status must be one of %s: %w", strings.Join(itemStatuses, ", "), errInvalidStatus)
+	}
+
+	var previousStatus string
+	var previousQuantity int
+	err := tx.QueryRowContext(ctx, "SELECT status, quantity FROM items WHERE id = $1", itemId).Scan(&previousStatus, &previousQuantity)
+	if err != nil {
+		return fmt.Errorf("setItemStatus: %w", err)
+	}
+
+	newQuantity := previousQuantity
+	switch {
+	case quantity != nil:
+		newQuantity = *quantity
+	case status != ItemStatusOwned:
+		newQuantity = 0
+	case previousStatus != ItemStatusOwned:
+		newQuantity = 1
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET status = $1, quantity = $2 WHERE id = $3", status, newQuantity, itemId); err != nil {
+		return fmt.Errorf("setItemStatus: %w", err)
+	}
+	if newQuantity != previousQuantity {
+		if err := recordQuantityChange(ctx, tx, int64(itemId), newQuantity-previousQuantity, newQuantity); err != nil {
+			return fmt.Errorf("setItemStatus: %w", err)
+		}
+	}
+	return nil
+}
@@ -3,23 +3,64 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
 type PostNewItemPayload struct {
-	Name        string `json:"name"`
-	Fingerprint string `json:"fingerprint"`
-	PhotoUrl    string `json:"photoUrl"`
-	Tags        []int  `json:"tags"`
+	Name         string        `json:"name"`
+	Fingerprint  string        `json:"fingerprint"`
+	Fingerprints []Fingerprint `json:"fingerprints"`
+	// PhotoUrl is rejected, see photoUrlReadOnly.
+	PhotoUrl string `json:"photoUrl"`
+	Tags     []int  `json:"tags"`
+	// Quantity is the number of copies owned, by default 1 for owned items
+	// and 0 otherwise.
+	Quantity *int `json:"quantity"`
+	// Status is one of itemStatuses, owned when not given.
+	Status string `json:"status"`
+	// Attributes are keyed by attribute key, see AttributeDefinition.
+	Attributes map[string]json.RawMessage `json:"attributes"`
+}
+
+// PatchItemPayload holds the item fields to change; nil fields are left as they are.
+type PatchItemPayload struct {
+	Name *string `json:"name"`
+	// PhotoUrl is set to the primary photo by the API, clients sending it
+	// are turned away with photoUrlReadOnly.
+	PhotoUrl     *string       `json:"photoUrl"`
+	Fingerprint  *string       `json:"fingerprint"`
+	Fingerprints []Fingerprint `json:"fingerprints"`
+	Status       *string       `json:"status"`
+	// Attributes set the given values and remove the ones set to null.
+	Attributes map[string]json.RawMessage `json:"attributes"`
 }
 
 type UpdateItemTagsPayload struct {
 	Tags []int `json:"tags"`
 }
 
+const (
+	defaultDuplicateMaxDistance = 4
+	maxDuplicateCandidates      = 10
+)
+
+// errDuplicateItem stops creating an item that looks like one in the catalog.
+var errDuplicateItem = errors.New("item looks like one already in the catalog")
+
+type DuplicateItemResponse struct {
+	Error      string        `json:"error"`
+	Duplicates []SimilarItem `json:"duplicates"`
+	// Wanted are wanted items the new owned item looks like; acquiring one of
+	// them is usually meant instead of adding a new item.
+	Wanted []SimilarItem `json:"wanted"`
+}
+
 func getItemPayloadFromBody(b io.ReadCloser) (PostNewItemPayload, error) {
 	var p PostNewItemPayload
 	if err := json.NewDecoder(b).Decode(&p); err != nil {
@@ -28,8 +69,67 @@ func getItemPayloadFromBody(b io.ReadCloser) (PostNewItemPayload, error) {
 	return p, nil
 }
 
-func checkNewItemValidity(payload PostNewItemPayload) bool {
-	return true
+// getItemPayloadFromRequest reads the new item either from a JSON body or from
+// a multipart form with the same JSON in a "payload" field and the photo in an
+// "image" field. When an image is sent its fingerprints are computed here and
+// replace whatever fingerprints the client sent.
+func getItemPayloadFromRequest(w http.ResponseWriter, r *http.Request) (PostNewItemPayload, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return getItemPayloadFromBody(r.Body)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadBytes)
+	if err := r.ParseMultipartForm(maxImageUploadBytes); err != nil {
+		return PostNewItemPayload{}, fmt.Errorf("parse multipart form: %w", err)
+	}
+
+	var p PostNewItemPayload
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), &p); err != nil {
+		return PostNewItemPayload{}, fmt.Errorf("parse payload field: %w", err)
+	}
+
+	file, _, err := r.FormFile("image")
+	if err == http.ErrMissingFile {
+		return p, nil
+	}
+	if err != nil {
+		return PostNewItemPayload{}, fmt.Errorf("read image field: %w", err)
+	}
+	defer file.Close()
+
+	img, err := decodeImage(file)
+	if err != nil {
+		return PostNewItemPayload{}, err
+	}
+	fingerprints, err := computeFingerprints(img)
+	if err != nil {
+		return PostNewItemPayload{}, err
+	}
+	// The legacy fingerprint is the browser's dHash, which this isn't
+	p.Fingerprint = ""
+	p.Fingerprints = fingerprints
+	return p, nil
+}
+
+// validateNewItem checks the new item against the catalog's attribute
+// definitions and returns its validated attribute values.
+func validateNewItem(payload PostNewItemPayload, defs []AttributeDefinition) (map[int]*attributeValue, error) {
+	if strings.TrimSpace(payload.Name) == "" {
+		return nil, fmt.Errorf("item name can't be empty")
+	}
+	if payload.Quantity != nil && *payload.Quantity < 0 {
+		return nil, fmt.Errorf("quantity can't be negative")
+	}
+	if payload.Status != "" && !slices.Contains(itemStatuses, payload.Status) {
+		return nil, fmt.Errorf("status must be one of %s", strings.Join(itemStatuses, ", "))
+	}
+	if payload.PhotoUrl != "" {
+		return nil, errors.New(photoUrlReadOnly)
+	}
+	if payload.Fingerprint == "" && len(payload.Fingerprints) == 0 {
+		return nil, fmt.Errorf("item needs a fingerprint or a photo")
+	}
+	return validateAttributes(defs, payload.Attributes, true)
 }
 
 func createItemsCollectionHandler(d DBService) CollectionRequestHandler {
@@ -40,31 +140,89 @@ func createItemsCollectionHandler(d DBService) CollectionRequestHandler {
 		defer cancel()
 
 		if r.Method == "GET" {
-			items, err := d.getAllItems(catalogId)
+			query, err := parseItemsQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			page, err := d.ListItems(catalogId, query)
+			if errors.Is(err, errTagNotFound) || errors.Is(err, errAttributeNotFound) || errors.Is(err, errInvalidAttribute) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if err != nil {
 				fmt.Println(err)
 				http.Error(w, "There was a problem with getting items", http.StatusInternalServerError)
 				return
 			}
-			json.NewEncoder(w).Encode(items)
+			if query.Limit == 0 {
+				json.NewEncoder(w).Encode(page.Items)
+				return
+			}
+			json.NewEncoder(w).Encode(page)
 			return
 		}
 
 		if r.Method == "POST" {
-			newItemPayload, err := getItemPayloadFromBody(r.Body)
+			newItemPayload, err := getItemPayloadFromRequest(w, r)
 			if err != nil {
 				fmt.Println(err)
 				http.Error(w, "There was a problem with parsing body", http.StatusBadRequest)
 				return
 			}
-			valid := checkNewItemValidity(newItemPayload)
-
-			if !valid {
-				http.Error(w, "Item is invalid", http.StatusBadRequest)
+			defs, err := d.GetAttributeDefinitions(catalogId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting attributes", http.StatusInternalServerError)
 				return
 			}
+			attributes, err := validateNewItem(newItemPayload, defs)
+			if err != nil {
+				http.Error(w, "Item is invalid: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// The duplicate check runs inside the create, so that two scans of
+			// the same object can't both pass it
+			var check func() error
+			var response DuplicateItemResponse
+			if r.URL.Query().Get("force") != "true" {
+				maxDistance, err := parseIntParam(r, "maxDistance", defaultDuplicateMaxDistance)
+				if err != nil || maxDistance < 0 || maxDistance > HashBits {
+					http.Error(w, fmt.Sprintf("Query parameter 'maxDistance' must be between 0 and %d", HashBits), http.StatusBadRequest)
+					return
+				}
+				check = func() error {
+					duplicates, err := d.FindDuplicateCandidates(catalogId, newItemPayload, maxDistance)
+					if err != nil {
+						return err
+					}
+					response = DuplicateItemResponse{Duplicates: []SimilarItem{}, Wanted: []SimilarItem{}}
+					for _, candidate := range duplicates {
+						if candidate.Item.Status == ItemStatusWanted && newItemPayload.Status != ItemStatusWanted {
+							response.Wanted = append(response.Wanted, candidate)
+						} else {
+							response.Duplicates = append(response.Duplicates, candidate)
+						}
+					}
+					if len(response.Duplicates) > 0 || len(response.Wanted) > 0 {
+						return errDuplicateItem
+					}
+					return nil
+				}
+			}
 
-			id, err := d.CreateNewItem(newItemPayload, catalogId, ctx)
+			id, err := d.CreateNewItem(newItemPayload, attributes, catalogId, check, ctx)
+			if errors.Is(err, errDuplicateItem) {
+				response.Error = "Item looks like one already in the catalog, pass force=true to add it anyway"
+				if len(response.Duplicates) == 0 {
+					response.Error = "Item looks like a wanted item, acquire it with POST /api/items/{id}/acquire or pass force=true to add it anyway"
+				}
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
 			if err != nil {
 				fmt.Println(err)
 				http.Error(w, "createItemsCollectionHandler: "+err.Error(), http.StatusBadRequest)
@@ -81,6 +239,92 @@ func createItemsResourceHandler(d DBService) ResourceRequestHandler {
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
+		if r.Method == "GET" {
+			item, err := d.GetItem(id, catalogId)
+			if errors.Is(err, errItemNotFound) {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the item", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(item)
+			return
+		}
+
+		if r.Method == "PATCH" {
+			var payload PatchItemPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if payload.Name != nil && strings.TrimSpace(*payload.Name) == "" {
+				http.Error(w, "Item name can't be empty", http.StatusBadRequest)
+				return
+			}
+			if payload.Status != nil && !slices.Contains(itemStatuses, *payload.Status) {
+				http.Error(w, "Status must be one of "+strings.Join(itemStatuses, ", "), http.StatusBadRequest)
+				return
+			}
+			if payload.PhotoUrl != nil {
+				http.Error(w, photoUrlReadOnly, http.StatusBadRequest)
+				return
+			}
+
+			defs, err := d.GetAttributeDefinitions(catalogId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting attributes", http.StatusInternalServerError)
+				return
+			}
+			attributes, err := validateAttributes(defs, payload.Attributes, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = d.UpdateItem(id, catalogId, payload, attributes, ctx)
+			if errors.Is(err, errItemNotFound) {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errInvalidFingerprint) || errors.Is(err, errInvalidAttribute) || errors.Is(err, errInvalidStatus) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with updating the item", http.StatusInternalServerError)
+				return
+			}
+
+			item, err := d.GetItem(id, catalogId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the item", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(item)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			err := d.TrashItem(id, catalogId, ctx)
+			if errors.Is(err, errItemNotFound) {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with moving the item to the trash", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			return
+		}
+
 		if r.Method == "PUT" {
 			var payload UpdateItemTagsPayload
 			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -102,3 +346,150 @@ func createItemsResourceHandler(d DBService) ResourceRequestHandler {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+type ChangeQuantityPayload struct {
+	Delta int `json:"delta"`
+}
+
+// createItemQuantityHandler shows the quantity history of an item on GET and
+// adds to or takes from its quantity on POST.
+func createItemQuantityHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "GET" && r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Method == "POST" {
+			ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+			defer cancel()
+
+			var payload ChangeQuantityPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Delta == 0 {
+				http.Error(w, "Body must be like {\"delta\": 1} with a non-zero delta", http.StatusBadRequest)
+				return
+			}
+
+			_, err := d.ChangeItemQuantity(id, catalogId, payload.Delta, ctx)
+			if errors.Is(err, errItemNotFound) {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errQuantityBelowZero) {
+				http.Error(w, "Quantity can't go below zero", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with changing the quantity", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		quantity, err := d.GetItemQuantity(id, catalogId)
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the quantity", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(quantity)
+	}
+}
+
+func createAcquireItemHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		var payload AcquireItemPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if payload.PhotoUrl != nil {
+			http.Error(w, photoUrlReadOnly, http.StatusBadRequest)
+			return
+		}
+
+		err := d.AcquireItem(id, catalogId, payload, ctx)
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errItemNotWanted) {
+			http.Error(w, "Only wanted items can be acquired", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errInvalidAcquireQuantity) {
+			http.Error(w, "Quantity must be at least 1", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errInvalidFingerprint) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with acquiring the item", http.StatusInternalServerError)
+			return
+		}
+
+		item, err := d.GetItem(id, catalogId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the item", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(item)
+	}
+}
+
+func createMergeItemsHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		var payload MergeItemsPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		err := d.MergeItems(id, catalogId, payload, ctx)
+		if errors.Is(err, errInvalidMerge) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with merging the items", http.StatusInternalServerError)
+			return
+		}
+
+		items, err := d.getItemsByIds(catalogId, []int{id})
+		if err != nil || len(items) == 0 {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the merged item", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(items[0])
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+var errInvalidMerge = errors.New("invalid merge")
+
+type MergeItemsPayload struct {
+	SourceIds []int `json:"sourceIds"`
+	// NameFrom and PhotoFrom pick the item whose name and photo (with its
+	// fingerprints) the merged item keeps. They default to the target item.
+	NameFrom  int `json:"nameFrom"`
+	PhotoFrom int `json:"photoFrom"`
+}
+
+// MergeItems folds the source items into the target item: the target gets the
+// union of their tags and photos, the sum of their quantities, the chosen name
+// and primary photo, and the sources are removed.
+// All items must belong to the catalog.
+func (c DBService) MergeItems(targetId int, catalogId int, payload MergeItemsPayload, ctx context.Context) error {
+	if len(payload.SourceIds) == 0 {
+		return fmt.Errorf("no source items given: %w", errInvalidMerge)
+	}
+	involved := map[int]bool{targetId: true}
+	for _, id := range payload.SourceIds {
+		if involved[id] {
+			return fmt.Errorf("item %d is listed more than once: %w", id, errInvalidMerge)
+		}
+		involved[id] = true
+	}
+	if payload.NameFrom == 0 {
+		payload.NameFrom = targetId
+	}
+	if payload.PhotoFrom == 0 {
+		payload.PhotoFrom = targetId
+	}
+	if !involved[payload.NameFrom] || !involved[payload.PhotoFrom] {
+		return fmt.Errorf("nameFrom and photoFrom must be one of the merged items: %w", errInvalidMerge)
+	}
+
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("MergeItems begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Verify all items belong to catalog, locking them in a stable order
+	ids := make([]int, 0, len(involved))
+	for id := range involved {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		var existingItemId int
+		err = tx.QueryRowContext(ctx, "SELECT id FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL FOR UPDATE", id, catalogId).Scan(&existingItemId)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("MergeItems item %d: %w", id, errItemNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("MergeItems verify item: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO items_tags(item_id, tag_id)
+		SELECT DISTINCT $1::integer, tag_id FROM items_tags WHERE item_id = ANY($2)
+		ON CONFLICT DO NOTHING
+	`, targetId, pq.Array(payload.SourceIds))
+	if err != nil {
+		return fmt.Errorf("MergeItems union tags: %w", err)
+	}
+
+	// Attributes the target lacks are taken from the first source having them
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO item_attributes(item_id, attribute_id, value_text, value_number, value_date, value_bool)
+		SELECT DISTINCT ON (attribute_id) $1::integer, attribute_id, value_text, value_number, value_date, value_bool
+		FROM item_attributes WHERE item_id = ANY($2)
+		ORDER BY attribute_id, array_position($2, item_id)
+		ON CONFLICT DO NOTHING
+	`, targetId, pq.Array(payload.SourceIds))
+	if err != nil {
+		return fmt.Errorf("MergeItems union attributes: %w", err)
+	}
+
+	// Photos of the sources follow the target's own, in the order of sources
+	_, err = tx.ExecContext(ctx, `
+		UPDATE item_photos ip SET item_id = $1, position = o.n
+		FROM (
+			SELECT photo_id, row_number() OVER (ORDER BY array_position($2::integer[], item_id) NULLS FIRST, position, photo_id) - 1 AS n
+			FROM item_photos WHERE item_id = $1 OR item_id = ANY($2)
+		) o
+		WHERE ip.photo_id = o.photo_id
+	`, targetId, pq.Array(payload.SourceIds))
+	if err != nil {
+		return fmt.Errorf("MergeItems move photos: %w", err)
+	}
+
+	// The merged item holds the copies of all of them
+	var added, quantity int
+	err = tx.QueryRowContext(ctx, `
+		WITH src AS (SELECT coalesce(sum(quantity), 0)::integer AS total FROM items WHERE id = ANY($2))
+		UPDATE items SET quantity = quantity + src.total
+		FROM src
+		WHERE items.id = $1
+		RETURNING src.total, items.quantity
+	`, targetId, pq.Array(payload.SourceIds)).Scan(&added, &quantity)
+	if err != nil {
+		return fmt.Errorf("MergeItems sum quantities: %w", err)
+	}
+	if added != 0 {
+		if err := recordQuantityChange(ctx, tx, int64(targetId), added, quantity); err != nil {
+			return fmt.Errorf("MergeItems: %w", err)
+		}
+	}
+
+	if payload.NameFrom != targetId {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE items SET name = src.name
+			FROM items src
+			WHERE items.id = $1 AND src.id = $2
+		`, targetId, payload.NameFrom)
+		if err != nil {
+			return fmt.Errorf("MergeItems copy name: %w", err)
+		}
+	}
+
+	if payload.PhotoFrom != targetId {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE items SET photo_url = src.photo_url, photo_id = src.photo_id, fingerprint = src.fingerprint, fingerprint_bigint = src.fingerprint_bigint
+			FROM items src
+			WHERE items.id = $1 AND src.id = $2
+		`, targetId, payload.PhotoFrom)
+		if err != nil {
+			return fmt.Errorf("MergeItems copy photo: %w", err)
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM item_fingerprints WHERE item_id = $1", targetId); err != nil {
+			return fmt.Errorf("MergeItems drop fingerprints: %w", err)
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE item_fingerprints SET item_id = $1 WHERE item_id = $2", targetId, payload.PhotoFrom); err != nil {
+			return fmt.Errorf("MergeItems move fingerprints: %w", err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE items SET updated_at = now() WHERE id = $1", targetId); err != nil {
+		return fmt.Errorf("MergeItems touch target: %w", err)
+	}
+	if err := refreshSearchVectors(ctx, tx, targetId); err != nil {
+		return fmt.Errorf("MergeItems: %w", err)
+	}
+
+	// Remove sources
+	if err := purgeItems(ctx, tx, payload.SourceIds); err != nil {
+		return fmt.Errorf("MergeItems: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("MergeItems commit: %w", err)
+	}
+
+	for _, id := range payload.SourceIds {
+		c.Index.Remove(catalogId, id)
+	}
+	// The target took over the photos of the sources
+	c.reindexItem(catalogId, targetId)
+	return nil
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultItemsPageSize = 50
+	maxItemsPageSize     = 500
+)
+
+type sortOption struct {
+	Expr string // SQL expression the rows are ordered by
+	Type string // Postgres type the cursor key is cast back to
+}
+
+var itemsSortOptions = map[string]sortOption{
+	"id":         {Expr: "i.id", Type: "integer"},
+	"name":       {Expr: "i.name", Type: "text"},
+	"created_at": {Expr: "i.created_at", Type: "timestamp"},
+	"updated_at": {Expr: "i.updated_at", Type: "timestamp"},
+	"quantity":   {Expr: "i.quantity", Type: "integer"},
+	"tag_count":  {Expr: "(SELECT count(*) FROM items_tags c WHERE c.item_id = i.id)", Type: "bigint"},
+}
+
+// ItemsQuery describes one page of GET /api/items.
+type ItemsQuery struct {
+	// Limit is the page size, 0 when all matching items are asked for.
+	Limit       int
+	Cursor      *pageCursor
+	Sort        string
+	Descending  bool
+	Name        string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	HasPhoto    *bool
+	AllTags     []int
+	AnyTags     []int
+	NotTags     []int
+	Attributes  []attributeFilter
+	Statuses    []string
+}
+
+// attributeFilter is a condition on an item attribute, read from query
+// parameters like attr.year=1999, attr.year.min=1990 or attr.year.max=2000.
+type attributeFilter struct {
+	Key   string
+	Op    string // "eq", "min" or "max"
+	Value string
+}
+
+type ItemsPage struct {
+	Items      []Item     `json:"items"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	Total      int        `json:"total"`
+	Facets     []TagFacet `json:"facets"`
+}
+
+// TagFacet tells how many items of the whole result set carry the tag.
+type TagFacet struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// pageCursor points right after the last row of a page, of items or tags. It
+// remembers the ordering it was made for so it can't be replayed against
+// another one.
+type pageCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d"`
+	Key        string `json:"k"`
+	Id         int    `json:"i"`
+}
+
+func (c pageCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodePageCursor(s string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// parseDateParam accepts either a date (2024-05-31) or an RFC 3339 timestamp.
+// With endOfDay a bare date stands for its last moment, so that date ranges
+// include their end day.
+func parseDateParam(r *http.Request, name string, endOfDay bool) (*time.Time, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+		}
+		return &t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return &t, nil
+	}
+	return nil, fmt.Errorf("query parameter '%s' must be a date like 2024-05-31 or an RFC 3339 timestamp", name)
+}
+
+func parseItemsQuery(r *http.Request) (ItemsQuery, error) {
+	params := r.URL.Query()
+	q := ItemsQuery{Sort: "id", Name: params.Get("name"), Statuses: []string{ItemStatusOwned}}
+	var err error
+
+	// Clients from before paging send none of these and get a bare array of
+	// all items
+	if params.Has("limit") || params.Has("cursor") || params.Get("paged") == "1" {
+		limit, err := parseIntParam(r, "limit", defaultItemsPageSize)
+		if err != nil || limit < 1 || limit > maxItemsPageSize {
+			return ItemsQuery{}, fmt.Errorf("query parameter 'limit' must be between 1 and %d", maxItemsPageSize)
+		}
+		q.Limit = limit
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		if _, ok := itemsSortOptions[sort]; !ok {
+			return ItemsQuery{}, fmt.Errorf("query parameter 'sort' must be one of id, name, created_at, updated_at, quantity, tag_count")
+		}
+		q.Sort = sort
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return ItemsQuery{}, fmt.Errorf("query parameter 'order' must be asc or desc")
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		c, err := decodePageCursor(cursor)
+		if err != nil {
+			return ItemsQuery{}, err
+		}
+		if c.Sort != q.Sort || c.Descending != q.Descending {
+			return ItemsQuery{}, fmt.Errorf("cursor was made for another sort order")
+		}
+		q.Cursor = c
+	}
+
+	if q.CreatedFrom, err = parseDateParam(r, "createdFrom", false); err != nil {
+		return ItemsQuery{}, err
+	}
+	if q.CreatedTo, err = parseDateParam(r, "createdTo", true); err != nil {
+		return ItemsQuery{}, err
+	}
+
+	if raw := params.Get("hasPhoto"); raw != "" {
+		hasPhoto, err := strconv.ParseBool(raw)
+		if err != nil {
+			return ItemsQuery{}, fmt.Errorf("query parameter 'hasPhoto' must be true or false")
+		}
+		q.HasPhoto = &hasPhoto
+	}
+
+	// Only owned items are listed unless asked for, "any" lists all of them
+	if raw := params.Get("status"); raw == "any" {
+		q.Statuses = nil
+	} else if raw != "" {
+		q.Statuses = strings.Split(raw, ",")
+		for _, status := range q.Statuses {
+			if !slices.Contains(itemStatuses, status) {
+				return ItemsQuery{}, fmt.Errorf("query parameter 'status' must be any or a list of %s", strings.Join(itemStatuses, ", "))
+			}
+		}
+	}
+
+	if err := parseTagFilters(r, &q); err != nil {
+		return ItemsQuery{}, err
+	}
+
+	for name, values := range params {
+		key, ok := strings.CutPrefix(name, "attr.")
+		if !ok {
+			continue
+		}
+		op := "eq"
+		if k, suffix, found := strings.Cut(key, "."); found {
+			if suffix != "min" && suffix != "max" {
+				return ItemsQuery{}, fmt.Errorf("query parameter '%s' must end with .min or .max", name)
+			}
+			key, op = k, suffix
+		}
+		for _, v := range values {
+			q.Attributes = append(q.Attributes, attributeFilter{Key: key, Op: op, Value: v})
+		}
+	}
+
+	return q, nil
+}
+
+// parseIdList reads comma separated ids like "1,2,3".
+func parseIdList(raw string) ([]int, error) {
+	ids := []int{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid id", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseTagFilters reads tag filters from the "all", "any" and "not" query
+// parameters, each a list of tag ids. The "tags" parameter takes the same
+// lists prefixed with their mode, e.g. tags=all:1,2 (a bare list means all).
+func parseTagFilters(r *http.Request, q *ItemsQuery) error {
+	params := r.URL.Query()
+	targets := map[string]*[]int{"all": &q.AllTags, "any": &q.AnyTags, "not": &q.NotTags}
+
+	for mode, target := range targets {
+		for _, raw := range params[mode] {
+			ids, err := parseIdList(raw)
+			if err != nil {
+				return fmt.Errorf("query parameter '%s': %w", mode, err)
+			}
+			*target = append(*target, ids...)
+		}
+	}
+
+	for _, raw := range params["tags"] {
+		mode, list, ok := strings.Cut(raw, ":")
+		if !ok {
+			mode, list = "all", raw
+		}
+		target, known := targets[mode]
+		if !known {
+			return fmt.Errorf("query parameter 'tags' must look like all:1,2, any:1,2 or not:1,2")
+		}
+		ids, err := parseIdList(list)
+		if err != nil {
+			return fmt.Errorf("query parameter 'tags': %w", err)
+		}
+		*target = append(*target, ids...)
+	}
+	return nil
+}
+
+// sqlConditions collects WHERE conditions together with their numbered arguments.
+type sqlConditions struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds a query argument and returns its placeholder.
+func (b *sqlConditions) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *sqlConditions) where(condition string) {
+	b.conditions = append(b.conditions, condition)
+}
+
+func (b *sqlConditions) sql() string {
+	return strings.Join(b.conditions, " AND ")
+}
+
+// escapeLike makes user input match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// itemsQueryConditions turns the filters of the query into SQL conditions.
+// A tag filter also matches items carrying any descendant of the tag, as
+// listed in subtrees.
+func itemsQueryConditions(catalogId int, q ItemsQuery, subtrees map[int][]int) *sqlConditions {
+	b := &sqlConditions{}
+	b.where("i.catalog_id = " + b.arg(catalogId))
+	b.where("i.deleted_at IS NULL")
+
+	if q.Name != "" {
+		b.where("i.name ILIKE " + b.arg("%"+escapeLike(q.Name)+"%"))
+	}
+	if len(q.Statuses) > 0 {
+		b.where("i.status = ANY(" + b.arg(pq.Array(q.Statuses)) + ")")
+	}
+	if q.CreatedFrom != nil {
+		b.where("i.created_at >= " + b.arg(*q.CreatedFrom))
+	}
+	if q.CreatedTo != nil {
+		b.where("i.created_at <= " + b.arg(*q.CreatedTo))
+	}
+	if q.HasPhoto != nil {
+		if *q.HasPhoto {
+			b.where("(i.photo_url IS NOT NULL AND i.photo_url <> '')")
+		} else {
+			b.where("(i.photo_url IS NULL OR i.photo_url = '')")
+		}
+	}
+	for _, id := range distinctIds(q.AllTags) {
+		b.where("EXISTS (SELECT 1 FROM items_tags x WHERE x.item_id = i.id AND x.tag_id = ANY(" + b.arg(pq.Array(subtrees[id])) + "))")
+	}
+	if len(q.AnyTags) > 0 {
+		b.where("EXISTS (SELECT 1 FROM items_tags x WHERE x.item_id = i.id AND x.tag_id = ANY(" + b.arg(pq.Array(expandTags(q.AnyTags, subtrees))) + "))")
+	}
+	if len(q.NotTags) > 0 {
+		b.where("NOT EXISTS (SELECT 1 FROM items_tags x WHERE x.item_id = i.id AND x.tag_id = ANY(" + b.arg(pq.Array(expandTags(q.NotTags, subtrees))) + "))")
+	}
+	return b
+}
+
+var attributeColumns = map[string]string{
+	AttributeText:    "value_text",
+	AttributeEnum:    "value_text",
+	AttributeNumber:  "value_number",
+	AttributeDate:    "value_date",
+	AttributeBoolean: "value_bool",
+}
+
+// addAttributeConditions adds the attribute filters to the conditions. Text
+// attributes match by substring, the others by value; min and max only apply
+// to numbers and dates.
+func addAttributeConditions(b *sqlConditions, defs []AttributeDefinition, filters []attributeFilter) error {
+	byKey := make(map[string]AttributeDefinition, len(defs))
+	for _, def := range defs {
+		byKey[def.Key] = def
+	}
+
+	for _, f := range filters {
+		def, ok := byKey[f.Key]
+		if !ok {
+			return fmt.Errorf("attribute %s: %w", f.Key, errAttributeNotFound)
+		}
+		if f.Op != "eq" && def.Type != AttributeNumber && def.Type != AttributeDate {
+			return fmt.Errorf("attribute %s can't be filtered by %s: %w", f.Key, f.Op, errInvalidAttribute)
+		}
+
+		column := attributeColumns[def.Type]
+		var condition string
+		switch def.Type {
+		case AttributeText:
+			condition = column + " ILIKE " + b.arg("%"+escapeLike(f.Value)+"%")
+		case AttributeEnum:
+			condition = column + " = " + b.arg(f.Value)
+		default:
+			raw := json.RawMessage(f.Value)
+			if def.Type == AttributeDate {
+				raw, _ = json.Marshal(f.Value)
+			}
+			v, err := parseAttributeValue(def, raw)
+			if err != nil {
+				return err
+			}
+			operator := map[string]string{"eq": "=", "min": ">=", "max": "<="}[f.Op]
+			condition = fmt.Sprintf("%s %s %s", column, operator, b.arg(v.json()))
+		}
+		b.where(fmt.Sprintf("EXISTS (SELECT 1 FROM item_attributes a WHERE a.item_id = i.id AND a.attribute_id = %s AND a.%s)",
+			b.arg(def.Id), condition))
+	}
+	return nil
+}
+
+// expandTags lists the tags together with all their descendants.
+func expandTags(ids []int, subtrees map[int][]int) []int {
+	expanded := []int{}
+	for _, id := range distinctIds(ids) {
+		expanded = append(expanded, subtrees[id]...)
+	}
+	return distinctIds(expanded)
+}
+
+func distinctIds(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	distinct := []int{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			distinct = append(distinct, id)
+		}
+	}
+	return distinct
+}
+
+// verifyTagsInCatalog makes sure all ids are tags of the catalog.
+func (c DBService) verifyTagsInCatalog(catalogId int, ids []int) error {
+	ids = distinctIds(ids)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	result, err := c.DB.Query("SELECT id FROM tags WHERE id = ANY($1) AND catalog_id = $2", pq.Array(ids), catalogId)
+	if err != nil {
+		return fmt.Errorf("verifyTagsInCatalog: %w", err)
+	}
+	defer result.Close()
+
+	found := make(map[int]bool, len(ids))
+	for result.Next() {
+		var id int
+		if err := result.Scan(&id); err != nil {
+			return fmt.Errorf("verifyTagsInCatalog scan: %w", err)
+		}
+		found[id] = true
+	}
+	if err := result.Err(); err != nil {
+		return fmt.Errorf("verifyTagsInCatalog rows: %w", err)
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			return fmt.Errorf("tag id %d does not exist in catalog: %w", id, errTagNotFound)
+		}
+	}
+	return nil
+}
+
+// getTagFacets counts the items matching the conditions per tag.
+func (c DBService) getTagFacets(conditions *sqlConditions) ([]TagFacet, error) {
+	result, err := c.DB.Query(`
+		SELECT t.id, t.name, count(*)
+		FROM items i
+		INNER JOIN items_tags it ON it.item_id = i.id
+		INNER JOIN tags t ON t.id = it.tag_id
+		WHERE `+conditions.sql()+`
+		GROUP BY t.id, t.name
+		ORDER BY count(*) DESC, t.name
+	`, conditions.args...)
+	if err != nil {
+		return []TagFacet{}, fmt.Errorf("getTagFacets query: %w", err)
+	}
+	defer result.Close()
+
+	facets := []TagFacet{}
+	for result.Next() {
+		var f TagFacet
+		if err := result.Scan(&f.Id, &f.Name, &f.Count); err != nil {
+			return []TagFacet{}, fmt.Errorf("getTagFacets scan: %w", err)
+		}
+		facets = append(facets, f)
+	}
+	return facets, result.Err()
+}
+
+// ListItems returns one page of the catalog's items matching the query,
+// together with the total number of matches and their tag facets.
+func (c DBService) ListItems(catalogId int, q ItemsQuery) (ItemsPage, error) {
+	tagIds := append(append(append([]int{}, q.AllTags...), q.AnyTags...), q.NotTags...)
+	if err := c.verifyTagsInCatalog(catalogId, tagIds); err != nil {
+		return ItemsPage{}, err
+	}
+
+	subtrees, err := c.tagSubtrees(catalogId, tagIds)
+	if err != nil {
+		return ItemsPage{}, fmt.Errorf("ListItems: %w", err)
+	}
+	conditions := itemsQueryConditions(catalogId, q, subtrees)
+	if len(q.Attributes) > 0 {
+		defs, err := c.GetAttributeDefinitions(catalogId)
+		if err != nil {
+			return ItemsPage{}, fmt.Errorf("ListItems: %w", err)
+		}
+		if err := addAttributeConditions(conditions, defs, q.Attributes); err != nil {
+			return ItemsPage{}, err
+		}
+	}
+
+	// All items are listed as they are, without a count or facets
+	var total int
+	facets := []TagFacet{}
+	if q.Limit > 0 {
+		if err := c.DB.QueryRow("SELECT count(*) FROM items i WHERE "+conditions.sql(), conditions.args...).Scan(&total); err != nil {
+			return ItemsPage{}, fmt.Errorf("ListItems count: %w", err)
+		}
+		if facets, err = c.getTagFacets(conditions); err != nil {
+			return ItemsPage{}, fmt.Errorf("ListItems: %w", err)
+		}
+	}
+
+	sort := itemsSortOptions[q.Sort]
+	direction, comparison := "ASC", ">"
+	if q.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if q.Cursor != nil {
+		conditions.where(fmt.Sprintf("(%s, i.id) %s (%s::%s, %s)",
+			sort.Expr, comparison, conditions.arg(q.Cursor.Key), sort.Type, conditions.arg(q.Cursor.Id)))
+	}
+
+	limit := "ALL"
+	if q.Limit > 0 {
+		limit = conditions.arg(q.Limit + 1)
+	}
+	query := fmt.Sprintf(`
+		SELECT i.id, (%s)::text
+		FROM items i
+		WHERE %s
+		ORDER BY %s %s, i.id %s
+		LIMIT %s
+	`, sort.Expr, conditions.sql(), sort.Expr, direction, direction, limit)
+	result, err := c.DB.Query(query, conditions.args...)
+	if err != nil {
+		return ItemsPage{}, fmt.Errorf("ListItems query: %w", err)
+	}
+	defer result.Close()
+
+	var ids []int
+	var keys []string
+	for result.Next() {
+		var id int
+		var key string
+		if err := result.Scan(&id, &key); err != nil {
+			return ItemsPage{}, fmt.Errorf("ListItems scan: %w", err)
+		}
+		ids = append(ids, id)
+		keys = append(keys, key)
+	}
+	if err := result.Err(); err != nil {
+		return ItemsPage{}, fmt.Errorf("ListItems rows: %w", err)
+	}
+
+	page := ItemsPage{Items: []Item{}, Total: total, Facets: facets}
+	if q.Limit > 0 && len(ids) > q.Limit {
+		ids, keys = ids[:q.Limit], keys[:q.Limit]
+		last := len(ids) - 1
+		page.NextCursor = pageCursor{Sort: q.Sort, Descending: q.Descending, Key: keys[last], Id: ids[last]}.encode()
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+
+	items, err := c.getItemsByIds(catalogId, ids)
+	if err != nil {
+		return ItemsPage{}, fmt.Errorf("ListItems items: %w", err)
+	}
+	itemsById := make(map[int]Item, len(items))
+	for _, item := range items {
+		itemsById[item.Id] = item
+	}
+	for _, id := range ids {
+		if item, ok := itemsById[id]; ok {
+			page.Items = append(page.Items, item)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errLoginBusy = errors.New("too many logins being checked at once")
+
+// maxConcurrentPasswordChecks bounds how many Argon2id hashes are computed at
+// once, as each of them takes argon2Params.Memory (64 MiB).
+const maxConcurrentPasswordChecks = 4
+
+var passwordCheckSlots = make(chan struct{}, maxConcurrentPasswordChecks)
+
+// acquirePasswordCheck waits for a free slot to hash a password in, giving up
+// with errLoginBusy when the context ends first.
+func acquirePasswordCheck(ctx context.Context) (release func(), err error) {
+	select {
+	case passwordCheckSlots <- struct{}{}:
+		return func() { <-passwordCheckSlots }, nil
+	case <-ctx.Done():
+		return nil, errLoginBusy
+	}
+}
+
+// loginLimiter is a token bucket per key: every attempt takes a token and
+// tokens come back at a steady rate up to the burst.
+type loginLimiter struct {
+	mu      sync.Mutex
+	burst   float64
+	every   time.Duration
+	buckets map[string]*loginBucket
+}
+
+type loginBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// maxLoginBuckets is how many keys are tracked before full buckets, which
+// behave like new ones, are dropped.
+const maxLoginBuckets = 10_000
+
+func newLoginLimiter(burst int, every time.Duration) *loginLimiter {
+	return &loginLimiter{burst: float64(burst), every: every, buckets: map[string]*loginBucket{}}
+}
+
+// refill tops the bucket up with the tokens that came back since it was last
+// looked at.
+func (l *loginLimiter) refill(b *loginBucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+float64(now.Sub(b.at))/float64(l.every))
+	b.at = now
+}
+
+// allow takes a token for the key, or tells how long until there is one.
+func (l *loginLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLoginBuckets {
+			for k, other := range l.buckets {
+				if l.refill(other, now); other.tokens >= l.burst {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &loginBucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(l.every))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Logins are limited both by the address they come from and by the catalog
+// name they try, so that guessing one catalog's password from many addresses
+// is slow as well.
+var (
+	loginsByAddress = newLoginLimiter(10, 6*time.Second)
+	loginsByName    = newLoginLimiter(5, 12*time.Second)
+)
+
+// loginAddress is the address a login comes from. Behind a reverse proxy
+// that is the proxy's, as forwarding headers can't be trusted here.
+func loginAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowLogin tells whether a login attempt may go ahead, or how long to wait
+// before the next one.
+func allowLogin(r *http.Request, name string) (bool, time.Duration) {
+	now := time.Now()
+	if ok, wait := loginsByAddress.allow(loginAddress(r), now); !ok {
+		return false, wait
+	}
+	return loginsByName.allow(name, now)
+}
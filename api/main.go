@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
 	"strconv"
@@ -32,7 +33,22 @@ func main() {
 	fmt.Println("Server listening at: localhost:" + string([]byte(port)))
 
 	db := initializeDB()
-	dbService := DBService{db}
+	blobs, err := newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dbService := DBService{DB: db, Index: NewFingerprintIndex(), Blobs: blobs}
+	// Similarity queries are answered from the index alone, so don't serve
+	// them from a partial one
+	if err := dbService.warmFingerprintIndex(); err != nil {
+		log.Fatalf("Error warming fingerprint index: %s", err)
+	}
+	rehashRunner := NewRehashRunner(dbService)
+	if err := rehashRunner.Resume(); err != nil {
+		log.Printf("Error resuming rehash job: %s", err)
+	}
+	startTrashPurger(dbService, trashRetention())
+	startPhotoCollector(dbService, photoCollectorGrace(), photoQuarantineRetention(), photoCollectorAction())
 
 	// static assets
 	fs := http.FileServer(http.Dir("dist/assets"))
@@ -41,10 +57,10 @@ func main() {
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/auth/login", authHandler(dbService))
-	http.HandleFunc("/api/", createApiHandler(dbService))
+	http.HandleFunc("/api/", createApiHandler(dbService, rehashRunner))
 
 	port = ":" + port
-	err := http.ListenAndServe(port, nil)
+	err = http.ListenAndServe(port, nil)
 	fmt.Println(err) // don't ignore errors
 }
 
@@ -64,15 +80,17 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type PostAuthLoginPayload struct {
+	Name     string `json:"name"`
 	Password string `json:"password"`
 }
 
-func getPasswordFromBody(b io.ReadCloser) (string, error) {
+func getLoginFromBody(b io.ReadCloser) (PostAuthLoginPayload, error) {
 	var p PostAuthLoginPayload
 	if err := json.NewDecoder(b).Decode(&p); err != nil {
-		return "", err
+		return PostAuthLoginPayload{}, err
 	}
-	return p.Password, nil
+	p.Name = strings.TrimSpace(p.Name)
+	return p, nil
 }
 
 func authHandler(cm DBService) http.HandlerFunc {
@@ -84,25 +102,43 @@ func authHandler(cm DBService) http.HandlerFunc {
 			// set cors
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 
-			password, err := getPasswordFromBody(r.Body)
+			login, err := getLoginFromBody(r.Body)
 			if err != nil {
-				log.Printf("Error getPasswordFromBody: %s", err)
+				log.Printf("Error getLoginFromBody: %s", err)
 				http.Error(w, "Bad request", http.StatusBadRequest)
 				return
 			}
 
-			if len(password) == 0 {
-				log.Printf("Empty password")
+			if len(login.Name) == 0 || len(login.Password) == 0 {
+				log.Printf("Empty name or password")
 				http.Error(w, "Bad request", http.StatusBadRequest)
 				return
 			}
 
-			catalog, err := cm.findCatalogByPasswordHash(password)
-			if err != nil {
-				log.Printf("Error cm.findCatalogByPasswordHash: %s", err)
+			if ok, wait := allowLogin(r, login.Name); !ok {
+				log.Printf("Too many logins from %s or to %q", loginAddress(r), login.Name)
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+				return
+			}
+
+			catalog, err := cm.authenticateCatalog(login.Name, login.Password)
+			if errors.Is(err, errLoginBusy) {
+				log.Printf("Error cm.authenticateCatalog: %s", err)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many logins at once, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			if errors.Is(err, errInvalidCredentials) {
+				log.Printf("Error cm.authenticateCatalog: %s", err)
 				http.Error(w, "Unathorized", http.StatusUnauthorized)
 				return
 			}
+			if err != nil {
+				log.Printf("Error cm.authenticateCatalog: %s", err)
+				http.Error(w, "There was a problem with logging in", http.StatusInternalServerError)
+				return
+			}
 
 			catalogAsJson, _ := json.Marshal(&catalog)
 			fmt.Println(string(catalogAsJson))
@@ -164,9 +200,32 @@ func extractCatalogId(payload string) int {
 	}
 	return p.Id
 }
-func createApiHandler(d DBService) http.HandlerFunc {
-	itemsHandler := createCollectionHandler("/api/items", createItemsCollectionHandler(d), createItemsResourceHandler(d))
-	tagsCollectionHandler := createCollectionHandler("/api/tags", createTagsCollectionHandler(d), createTagsResourceHandler(d))
+func createApiHandler(d DBService, rehash *RehashRunner) http.HandlerFunc {
+	itemsHandler := withSubroutes("/api/items", map[string]CollectionRequestHandler{
+		"similar":    createSimilarItemsHandler(d),
+		"duplicates": createDuplicatesHandler(d),
+	}, withResourceActions("/api/items", map[string]ResourceRequestHandler{
+		"merge":    createMergeItemsHandler(d),
+		"restore":  createRestoreItemHandler(d),
+		"quantity": createItemQuantityHandler(d),
+		"acquire":  createAcquireItemHandler(d),
+		"photo":    createItemPhotoHandler(d),
+		"photos":   createItemPhotosHandler(d),
+	}, createCollectionHandler("/api/items", createItemsCollectionHandler(d), createItemsResourceHandler(d))))
+	tagsCollectionHandler := withSubroutes("/api/tags", map[string]CollectionRequestHandler{
+		"tree": createTagTreeHandler(d),
+	}, withResourceActions("/api/tags", map[string]ResourceRequestHandler{
+		"merge": createMergeTagsHandler(d),
+	}, createCollectionHandler("/api/tags", createTagsCollectionHandler(d), createTagsResourceHandler(d))))
+	attributesHandler := createCollectionHandler("/api/attributes", createAttributesCollectionHandler(d), createAttributesResourceHandler(d))
+	photosHandler := withResourceActions("/api/photos", map[string]ResourceRequestHandler{
+		"raw": createPhotosResourceHandler(d),
+	}, createCollectionHandler("/api/photos", func(w http.ResponseWriter, r *http.Request, catalogId int) { notFound(w, r) }, createPhotosResourceHandler(d)))
+	trashHandler := createCollectionHandler("/api/trash", createTrashCollectionHandler(d), createTrashResourceHandler(d))
+	searchHandler := withSubroutes("/api/search", map[string]CollectionRequestHandler{
+		"": createSearchHandler(d),
+	}, func(w http.ResponseWriter, r *http.Request, catalogId int) { notFound(w, r) })
+	adminHandler := createAdminHandler(d, rehash)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		var claims *jwt.RegisteredClaims
@@ -194,6 +253,31 @@ func createApiHandler(d DBService) http.HandlerFunc {
 			return
 		}
 
+		if strings.HasPrefix(r.URL.Path, "/api/attributes") {
+			attributesHandler(w, r, catalogId)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/photos") {
+			photosHandler(w, r, catalogId)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/trash") {
+			trashHandler(w, r, catalogId)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/search") {
+			searchHandler(w, r, catalogId)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/admin") {
+			adminHandler(w, r, catalogId)
+			return
+		}
+
 		notFound(w, r)
 	}
 }
@@ -224,3 +308,35 @@ func createCollectionHandler(prefix string, handleCollectionRequest CollectionRe
 		}
 	}
 }
+
+// withSubroutes dispatches named sub-paths of prefix (e.g. /api/items/similar)
+// to their own handlers and everything else to next.
+func withSubroutes(prefix string, routes map[string]CollectionRequestHandler, next CollectionHandlerWrapper) CollectionHandlerWrapper {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if handler, ok := routes[name]; ok {
+			w.Header().Set("Content-Type", "application/json")
+			handler(w, r, catalogId)
+			return
+		}
+		next(w, r, catalogId)
+	}
+}
+
+// withResourceActions dispatches actions on a single resource (e.g.
+// /api/items/{id}/merge) to their own handlers and everything else to next.
+func withResourceActions(prefix string, actions map[string]ResourceRequestHandler, next CollectionHandlerWrapper) CollectionHandlerWrapper {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+		if len(segments) == 2 {
+			id, err := strconv.Atoi(segments[0])
+			handler, ok := actions[segments[1]]
+			if err == nil && ok {
+				w.Header().Set("Content-Type", "application/json")
+				handler(w, r, catalogId, id)
+				return
+			}
+		}
+		next(w, r, catalogId)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var errInvalidCredentials = errors.New("invalid catalog name or password")
+
+// argon2Params are what new password hashes are made with, the second
+// recommendation of RFC 9106. Hashes made with others are still verified
+// and made again on the next login.
+var argon2Params = struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}{Memory: 64 * 1024, Time: 3, Threads: 4, SaltLen: 16, KeyLen: 32}
+
+// dummyPasswordHash is verified against when no catalog has the name, so
+// unknown names take as long as wrong passwords.
+var dummyPasswordHash, _ = hashPassword("")
+
+// hashPassword makes a salted Argon2id hash of the password in the PHC string
+// format, which is also what Bun.password.hash produces.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2Params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("hashPassword: %w", err)
+	}
+	p := argon2Params
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword tells whether the password matches the hash, and whether the
+// hash should be made again: legacy base64 MD5 hashes and Argon2id hashes
+// made with other parameters.
+func verifyPassword(password string, hash string) (ok bool, outdated bool) {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		legacy := md5.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(legacy[:])
+		return subtle.ConstantTimeCompare([]byte(encoded), []byte(hash)) == 1, true
+	}
+
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || threads == 0 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false
+	}
+	p := argon2Params
+	outdated = memory != p.Memory || iterations != p.Time || threads != p.Threads || len(salt) != p.SaltLen || uint32(len(key)) != p.KeyLen
+	return true, outdated
+}
+
+// authenticateCatalog finds the catalog by name and checks its password,
+// storing a fresh hash of the password when the stored one is outdated. The
+// hashing waits for one of the password check slots, see
+// acquirePasswordCheck.
+func (c DBService) authenticateCatalog(name string, password string) (Catalog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	release, err := acquirePasswordCheck(ctx)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("authenticateCatalog: %w", err)
+	}
+	defer release()
+
+	var cat Catalog
+	var hash string
+	err = c.DB.QueryRowContext(ctx, "SELECT id, name, password FROM catalogs WHERE name = $1", name).Scan(&cat.Id, &cat.Name, &hash)
+	if err == sql.ErrNoRows {
+		verifyPassword(password, dummyPasswordHash)
+		return Catalog{}, fmt.Errorf("authenticateCatalog %q: %w", name, errInvalidCredentials)
+	}
+	if err != nil {
+		return Catalog{}, fmt.Errorf("authenticateCatalog: %w", err)
+	}
+
+	ok, outdated := verifyPassword(password, hash)
+	if !ok {
+		return Catalog{}, fmt.Errorf("authenticateCatalog %q: %w", name, errInvalidCredentials)
+	}
+	if outdated {
+		// The login goes ahead even when the new hash can't be stored, the
+		// next one tries again
+		if err := c.rehashCatalogPassword(ctx, cat.Id, password, hash); err != nil {
+			log.Printf("Error rehashing password of catalog %d: %s", cat.Id, err)
+		}
+	}
+	return cat, nil
+}
+
+// rehashCatalogPassword replaces the catalog's password hash, unless it was
+// changed since it was read.
+func (c DBService) rehashCatalogPassword(ctx context.Context, catalogId int, password string, oldHash string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := c.DB.ExecContext(ctx, "UPDATE catalogs SET password = $1 WHERE id = $2 AND password = $3", hash, catalogId, oldHash); err != nil {
+		return fmt.Errorf("rehashCatalogPassword: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	PhotoCollectorDelete     = "delete"
+	PhotoCollectorQuarantine = "quarantine"
+
+	photoCollectorInterval = 6 * time.Hour
+	photoBlobPrefix        = "photos/"
+	quarantineBlobPrefix   = "quarantine/"
+)
+
+// photoCollectorGrace is how old an orphaned photo must be before it is
+// collected, PHOTO_GC_GRACE_HOURS in the environment (24 by default). It
+// keeps uploads that are still being saved out of reach.
+func photoCollectorGrace() time.Duration {
+	hours, err := strconv.Atoi(getEnv("PHOTO_GC_GRACE_HOURS", "24"))
+	if err != nil || hours < 1 {
+		hours = 24
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// photoQuarantineRetention is how long quarantined blobs are kept before the
+// collector purges them, PHOTO_GC_QUARANTINE_DAYS in the environment (30 by
+// default).
+func photoQuarantineRetention() time.Duration {
+	days, err := strconv.Atoi(getEnv("PHOTO_GC_QUARANTINE_DAYS", "30"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// photoCollectorAction is what happens to orphans, PHOTO_GC_ACTION in the
+// environment: "quarantine" (the default) moves their blobs under
+// quarantine/, "delete" removes them for good.
+func photoCollectorAction() string {
+	if getEnv("PHOTO_GC_ACTION", PhotoCollectorQuarantine) == PhotoCollectorDelete {
+		return PhotoCollectorDelete
+	}
+	return PhotoCollectorQuarantine
+}
+
+// OrphanReport lists what a collection run found, and unless it was a dry
+// run, collected.
+type OrphanReport struct {
+	DryRun    bool      `json:"dryRun"`
+	Action    string    `json:"action"`
+	Cutoff    time.Time `json:"cutoff"`
+	BlobsSeen int       `json:"blobsSeen"`
+	// Photos are ids of photo rows no item refers to.
+	Photos     []int      `json:"photos"`
+	Blobs      []BlobInfo `json:"blobs"`
+	TotalBytes int64      `json:"totalBytes"`
+	// Purged are quarantined blobs kept past the retention.
+	Purged []BlobInfo `json:"purged"`
+	Errors []string   `json:"errors"`
+}
+
+// photoCollectorMu keeps the periodic run and runs asked for by admins apart.
+var photoCollectorMu sync.Mutex
+
+// photoKeyOfBlob strips the variant suffix off a blob key, giving the key of
+// the photo the blob belongs to.
+func photoKeyOfBlob(key string) string {
+	for size := range photoSizes {
+		if base, ok := strings.CutSuffix(key, "."+size); ok {
+			return base
+		}
+	}
+	return key
+}
+
+// orphanedPhotos finds photo rows older than the cutoff that no item refers to.
+func (c DBService) orphanedPhotos(ctx context.Context, cutoff time.Time) (map[int]string, error) {
+	result, err := c.DB.QueryContext(ctx, `
+		SELECT p.id, p.blob_key
+		FROM photos p
+		WHERE p.created_at < $1
+			AND NOT EXISTS (SELECT 1 FROM item_photos ip WHERE ip.photo_id = p.id)
+			AND NOT EXISTS (SELECT 1 FROM items i WHERE i.photo_id = p.id)
+	`, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("orphanedPhotos query: %w", err)
+	}
+	defer result.Close()
+
+	photos := map[int]string{}
+	for result.Next() {
+		var id int
+		var key string
+		if err := result.Scan(&id, &key); err != nil {
+			return nil, fmt.Errorf("orphanedPhotos scan: %w", err)
+		}
+		photos[id] = key
+	}
+	return photos, result.Err()
+}
+
+// referencedPhotoKeys returns the blob keys of all photo rows.
+func (c DBService) referencedPhotoKeys(ctx context.Context) (map[string]bool, error) {
+	result, err := c.DB.QueryContext(ctx, "SELECT blob_key FROM photos")
+	if err != nil {
+		return nil, fmt.Errorf("referencedPhotoKeys query: %w", err)
+	}
+	defer result.Close()
+
+	keys := map[string]bool{}
+	for result.Next() {
+		var key string
+		if err := result.Scan(&key); err != nil {
+			return nil, fmt.Errorf("referencedPhotoKeys scan: %w", err)
+		}
+		keys[key] = true
+	}
+	return keys, result.Err()
+}
+
+// deleteOrphanedPhotos deletes photo rows unless an item took them up since
+// they were found, returning the ids it deleted.
+func (c DBService) deleteOrphanedPhotos(ctx context.Context, ids []int) ([]int, error) {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("deleteOrphanedPhotos begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Linking a photo to an item needs a key share lock on it, so they can't
+	// be taken up once locked here
+	var orphans []int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT coalesce(array_agg(id), '{}') FROM (
+			SELECT p.id FROM photos p
+			WHERE p.id = ANY($1)
+				AND NOT EXISTS (SELECT 1 FROM item_photos ip WHERE ip.photo_id = p.id)
+				AND NOT EXISTS (SELECT 1 FROM items i WHERE i.photo_id = p.id)
+			FOR UPDATE
+		) o
+	`, pq.Array(ids)).Scan(pq.Array(&orphans))
+	if err != nil {
+		return nil, fmt.Errorf("deleteOrphanedPhotos lock: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photo_fingerprints WHERE photo_id = ANY($1)", pq.Array(orphans)); err != nil {
+		return nil, fmt.Errorf("deleteOrphanedPhotos fingerprints: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photos WHERE id = ANY($1)", pq.Array(orphans)); err != nil {
+		return nil, fmt.Errorf("deleteOrphanedPhotos: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("deleteOrphanedPhotos commit: %w", err)
+	}
+
+	deleted := make([]int, len(orphans))
+	for i, id := range orphans {
+		deleted[i] = int(id)
+	}
+	return deleted, nil
+}
+
+// quarantineBlob moves the blob under quarantine/, where it stays until it is
+// purged, see purgeQuarantine.
+func (c DBService) quarantineBlob(ctx context.Context, key string) error {
+	blob, err := c.Blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return fmt.Errorf("quarantineBlob read: %w", err)
+	}
+	if err := c.Blobs.Put(ctx, quarantineBlobPrefix+key, data, "application/octet-stream"); err != nil {
+		return err
+	}
+	return c.Blobs.Delete(ctx, key)
+}
+
+// purgeQuarantine deletes quarantined blobs put there before purgeBefore,
+// adding them to the report.
+func (c DBService) purgeQuarantine(ctx context.Context, purgeBefore time.Time, dryRun bool, report *OrphanReport) error {
+	blobs, err := c.Blobs.List(ctx, quarantineBlobPrefix)
+	if err != nil {
+		return fmt.Errorf("purgeQuarantine: %w", err)
+	}
+	for _, blob := range blobs {
+		if !blob.ModifiedAt.Before(purgeBefore) {
+			continue
+		}
+		if !dryRun {
+			if err := c.Blobs.Delete(ctx, blob.Key); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", blob.Key, err))
+				continue
+			}
+		}
+		report.Purged = append(report.Purged, blob)
+	}
+	return nil
+}
+
+// CollectOrphanedPhotos finds photo rows no item refers to and blobs no photo
+// refers to, both older than the cutoff, and unless dryRun is set deletes the
+// rows and deletes or quarantines the blobs. Quarantined blobs older than
+// purgeBefore are deleted in the same run. Failures on single blobs are
+// reported and don't stop the run.
+func (c DBService) CollectOrphanedPhotos(ctx context.Context, cutoff time.Time, purgeBefore time.Time, action string, dryRun bool) (OrphanReport, error) {
+	photoCollectorMu.Lock()
+	defer photoCollectorMu.Unlock()
+
+	report := OrphanReport{DryRun: dryRun, Action: action, Cutoff: cutoff, Photos: []int{}, Blobs: []BlobInfo{}, Purged: []BlobInfo{}, Errors: []string{}}
+
+	orphanedRows, err := c.orphanedPhotos(ctx, cutoff)
+	if err != nil {
+		return report, err
+	}
+	ids := make([]int, 0, len(orphanedRows))
+	for id := range orphanedRows {
+		ids = append(ids, id)
+	}
+	if !dryRun && len(ids) > 0 {
+		if ids, err = c.deleteOrphanedPhotos(ctx, ids); err != nil {
+			return report, err
+		}
+	}
+	report.Photos = ids
+
+	// Listed after the rows are gone, so their blobs show up as orphans too
+	referenced, err := c.referencedPhotoKeys(ctx)
+	if err != nil {
+		return report, err
+	}
+	if dryRun {
+		for _, id := range ids {
+			delete(referenced, orphanedRows[id])
+		}
+	}
+	blobs, err := c.Blobs.List(ctx, photoBlobPrefix)
+	if err != nil {
+		return report, fmt.Errorf("CollectOrphanedPhotos: %w", err)
+	}
+	report.BlobsSeen = len(blobs)
+
+	for _, blob := range blobs {
+		if referenced[photoKeyOfBlob(blob.Key)] || !blob.ModifiedAt.Before(cutoff) {
+			continue
+		}
+		if !dryRun {
+			var err error
+			if action == PhotoCollectorDelete {
+				err = c.Blobs.Delete(ctx, blob.Key)
+			} else {
+				err = c.quarantineBlob(ctx, blob.Key)
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", blob.Key, err))
+				continue
+			}
+		}
+		report.Blobs = append(report.Blobs, blob)
+		report.TotalBytes += blob.Size
+	}
+
+	if err := c.purgeQuarantine(ctx, purgeBefore, dryRun, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// startPhotoCollector periodically collects photos orphaned for longer than
+// the grace period and purges blobs quarantined for longer than retention.
+func startPhotoCollector(d DBService, grace time.Duration, retention time.Duration, action string) {
+	collect := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		defer cancel()
+
+		now := time.Now()
+		report, err := d.CollectOrphanedPhotos(ctx, now.Add(-grace), now.Add(-retention), action, false)
+		if err != nil {
+			log.Printf("Error collecting orphaned photos: %s", err)
+			return
+		}
+		if len(report.Photos) > 0 || len(report.Blobs) > 0 {
+			log.Printf("Collected %d orphaned photos and %d blobs (%d bytes, %s)", len(report.Photos), len(report.Blobs), report.TotalBytes, action)
+		}
+		if len(report.Purged) > 0 {
+			log.Printf("Purged %d quarantined blobs", len(report.Purged))
+		}
+		for _, e := range report.Errors {
+			log.Printf("Error collecting blob %s", e)
+		}
+	}
+
+	go func() {
+		collect()
+		for range time.Tick(photoCollectorInterval) {
+			collect()
+		}
+	}()
+}
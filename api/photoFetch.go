@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errPhotoHostNotAllowed = errors.New("photo host is not allowed")
+
+// cgnatRange is the shared address space of carrier-grade NAT, which
+// net.IP.IsPrivate doesn't cover.
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// photoFetchHosts are the hosts photos kept elsewhere may be fetched from,
+// PHOTO_FETCH_HOSTS in the environment, separated with commas. Nothing is
+// fetched when it's empty.
+func photoFetchHosts() []string {
+	hosts := []string{}
+	for _, raw := range strings.Split(getEnv("PHOTO_FETCH_HOSTS", ""), ",") {
+		if host := strings.ToLower(strings.TrimSpace(raw)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// checkPhotoFetchUrl makes sure the URL points at one of the allowed hosts.
+func checkPhotoFetchUrl(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("checkPhotoFetchUrl: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("checkPhotoFetchUrl %s: %w", raw, errPhotoHostNotAllowed)
+	}
+	if !slices.Contains(photoFetchHosts(), strings.ToLower(u.Hostname())) {
+		return nil, fmt.Errorf("checkPhotoFetchUrl %s: %w", raw, errPhotoHostNotAllowed)
+	}
+	return u, nil
+}
+
+// isPublicIP tells whether the address is routable on the internet, so that
+// allowed hosts resolving to internal addresses can't be used to reach them.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || cgnatRange.Contains(ip))
+}
+
+// photoFetchDialer checks the address a connection goes to after the host name
+// was resolved, so a name can't resolve to a public address when checked and
+// an internal one when dialled.
+var photoFetchDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+			return fmt.Errorf("dial %s: %w", address, errPhotoHostNotAllowed)
+		}
+		return nil
+	},
+}
+
+// photoHttpClient doesn't follow redirects, they could lead off the allowed
+// hosts, nor goes through a proxy, which would hide the address dialled.
+var photoHttpClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: &http.Transport{DialContext: photoFetchDialer.DialContext, Proxy: nil},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// fetchItemPhoto downloads the original photo of an item from the file
+// service, which has to be one of the allowed photo hosts.
+func fetchItemPhoto(ctx context.Context, photoUrl string) (image.Image, error) {
+	u, err := checkPhotoFetchUrl(photoUrl + "/raw")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetchItemPhoto: %w", err)
+	}
+	res, err := photoHttpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetchItemPhoto: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetchItemPhoto: %s responded with %s", photoUrl, res.Status)
+	}
+	return decodeImage(io.LimitReader(res.Body, maxImageUploadBytes))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"maps"
+	"path"
+	"slices"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+const (
+	PhotoSizeThumb  = "thumb"
+	PhotoSizeMedium = "medium"
+	PhotoSizeFull   = "full"
+
+	photoVariantQuality = 85
+)
+
+// photoSizes are the variants made of every photo, by the longest side they
+// are shrunk to. Smaller photos are not enlarged.
+var photoSizes = map[string]int{
+	PhotoSizeThumb:  160,
+	PhotoSizeMedium: 800,
+	PhotoSizeFull:   2048,
+}
+
+// PhotoVariantUrls point at the variants of an item's photo.
+type PhotoVariantUrls struct {
+	Thumb  string `json:"thumb"`
+	Medium string `json:"medium"`
+	Full   string `json:"full"`
+}
+
+func photoVariantUrls(photoId int) *PhotoVariantUrls {
+	base := photoUrl(photoId)
+	return &PhotoVariantUrls{
+		Thumb:  base + "?size=" + PhotoSizeThumb,
+		Medium: base + "?size=" + PhotoSizeMedium,
+		Full:   base + "?size=" + PhotoSizeFull,
+	}
+}
+
+// variantBlobKey is where the variant of the photo stored under key is cached.
+func variantBlobKey(key string, size string) string {
+	return key + "." + size
+}
+
+// photoVariantETag changes only with the photo, whose blob is never rewritten.
+func photoVariantETag(photo Photo, size string) string {
+	return fmt.Sprintf(`"%s-%s"`, path.Base(photo.BlobKey), size)
+}
+
+// makePhotoVariant shrinks the photo to fit the size and encodes it as a JPEG
+// without any metadata. The shrunk image is returned too, for smaller
+// variants to be made of.
+func makePhotoVariant(img image.Image, size string) (*image.RGBA, []byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if longest := max(w, h); longest > photoSizes[size] {
+		w = max(1, w*photoSizes[size]/longest)
+		h = max(1, h*photoSizes[size]/longest)
+	}
+
+	// Transparent parts end up white rather than black
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: photoVariantQuality}); err != nil {
+		return nil, nil, fmt.Errorf("makePhotoVariant: %w", err)
+	}
+	return dst, out.Bytes(), nil
+}
+
+// storePhotoVariants makes and caches all variants of a newly stored photo,
+// each one shrunk from the next larger one.
+func (c DBService) storePhotoVariants(ctx context.Context, key string, img image.Image) error {
+	sizes := slices.Collect(maps.Keys(photoSizes))
+	slices.SortFunc(sizes, func(a, b string) int { return photoSizes[b] - photoSizes[a] })
+	for _, size := range sizes {
+		shrunk, variant, err := makePhotoVariant(img, size)
+		if err != nil {
+			return err
+		}
+		img = shrunk
+		if err := c.Blobs.Put(ctx, variantBlobKey(key, size), variant, "image/jpeg"); err != nil {
+			return fmt.Errorf("storePhotoVariants: %w", err)
+		}
+	}
+	return nil
+}
+
+// deletePhotoBlobs removes the photo's original and cached variants.
+func (c DBService) deletePhotoBlobs(ctx context.Context, key string) error {
+	for size := range photoSizes {
+		if err := c.Blobs.Delete(ctx, variantBlobKey(key, size)); err != nil {
+			return err
+		}
+	}
+	return c.Blobs.Delete(ctx, key)
+}
+
+// getPhotoVariant returns the cached variant of the photo, making it from
+// the original when it isn't cached yet.
+func (c DBService) getPhotoVariant(ctx context.Context, photo Photo, size string) ([]byte, error) {
+	key := variantBlobKey(photo.BlobKey, size)
+	blob, err := c.Blobs.Get(ctx, key)
+	if err == nil {
+		defer blob.Close()
+		return io.ReadAll(blob)
+	}
+	if !errors.Is(err, errBlobNotFound) {
+		return nil, fmt.Errorf("getPhotoVariant: %w", err)
+	}
+
+	original, err := c.Blobs.Get(ctx, photo.BlobKey)
+	if err != nil {
+		return nil, fmt.Errorf("getPhotoVariant: %w", err)
+	}
+	defer original.Close()
+	img, err := decodeImage(io.LimitReader(original, maxImageUploadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("getPhotoVariant: %w", err)
+	}
+	_, variant, err := makePhotoVariant(img, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Blobs.Put(ctx, key, variant, "image/jpeg"); err != nil {
+		log.Printf("Error caching variant %s: %s", key, err)
+	}
+	return variant, nil
+}
+
+// jpegOrientation reads the EXIF orientation (1 to 8) of a JPEG image,
+// returning 1 when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// Start of scan, no metadata after it
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orientationTransforms map the pixel centres of an image of size w x h to
+// where they end up once it is upright, for each EXIF orientation.
+var orientationTransforms = map[int]func(w, h float64) f64.Aff3{
+	2: func(w, h float64) f64.Aff3 { return f64.Aff3{-1, 0, w, 0, 1, 0} },  // mirrored
+	3: func(w, h float64) f64.Aff3 { return f64.Aff3{-1, 0, w, 0, -1, h} }, // rotated 180°
+	4: func(w, h float64) f64.Aff3 { return f64.Aff3{1, 0, 0, 0, -1, h} },  // mirrored vertically
+	5: func(w, h float64) f64.Aff3 { return f64.Aff3{0, 1, 0, 1, 0, 0} },   // mirrored along the main diagonal
+	6: func(w, h float64) f64.Aff3 { return f64.Aff3{0, -1, h, 1, 0, 0} },  // rotated 90° clockwise
+	7: func(w, h float64) f64.Aff3 { return f64.Aff3{0, -1, h, -1, 0, w} }, // mirrored along the anti-diagonal
+	8: func(w, h float64) f64.Aff3 { return f64.Aff3{0, 1, 0, -1, 0, w} },  // rotated 90° counter-clockwise
+}
+
+// applyOrientation turns the image upright for an EXIF orientation. The
+// transforms only move whole pixels, so nearest neighbour sampling copies
+// them exactly, using the fast paths draw has for decoded image types.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	transform, ok := orientationTransforms[orientation]
+	if !ok {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	m := transform(float64(w), float64(h))
+	// Source coordinates start at the corner of the bounds
+	minX, minY := float64(b.Min.X), float64(b.Min.Y)
+	m[2] -= m[0]*minX + m[1]*minY
+	m[5] -= m[3]*minX + m[4]*minY
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.NearestNeighbor.Transform(dst, m, img, b, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"time"
+)
+
+var errPhotoNotFound = errors.New("photo not found")
+
+// Photo is an image kept in the blob store. Items point at their photo with
+// photo_id and get photoUrl set to its URL.
+type Photo struct {
+	Id          int       `json:"id"`
+	CatalogId   int       `json:"catalogId"`
+	BlobKey     string    `json:"-"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// photoUrl is where the photo is served from, see createPhotosResourceHandler.
+func photoUrl(photoId int) string {
+	return fmt.Sprintf("/api/photos/%d", photoId)
+}
+
+// photoUrlReadOnly is the answer to payloads setting photoUrl: items only point
+// at photos the API stored, which are uploaded to /api/items/{id}/photo.
+const photoUrlReadOnly = "photoUrl can't be set, upload the photo with POST /api/items/{id}/photo instead"
+
+// photoUpload is an uploaded image with the fingerprints computed from it.
+// Image is the decoded photo, turned upright, that variants are made of.
+type photoUpload struct {
+	Data         []byte
+	ContentType  string
+	Image        image.Image
+	Fingerprints []Fingerprint
+}
+
+// newPhotoBlobKey makes an unguessable key for a new photo of the catalog.
+func newPhotoBlobKey(catalogId int) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("newPhotoBlobKey: %w", err)
+	}
+	return fmt.Sprintf("photos/%d/%s", catalogId, hex.EncodeToString(b)), nil
+}
+
+// GetPhoto returns a photo of the catalog.
+func (c DBService) GetPhoto(photoId int, catalogId int, ctx context.Context) (Photo, error) {
+	var p Photo
+	err := c.DB.QueryRowContext(ctx, `
+		SELECT id, catalog_id, blob_key, content_type, size, created_at
+		FROM photos
+		WHERE id = $1 AND catalog_id = $2
+	`, photoId, catalogId).Scan(&p.Id, &p.CatalogId, &p.BlobKey, &p.ContentType, &p.Size, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Photo{}, fmt.Errorf("GetPhoto %d: %w", photoId, errPhotoNotFound)
+	}
+	if err != nil {
+		return Photo{}, fmt.Errorf("GetPhoto: %w", err)
+	}
+	return p, nil
+}
+
+// discardPhotoBlobs removes the blobs of a photo nothing points at, logging failures.
+func (c DBService) discardPhotoBlobs(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.deletePhotoBlobs(ctx, key); err != nil {
+		log.Printf("Error deleting blob %s: %s", key, err)
+	}
+}
+
+// loadPhotoImage decodes the stored image under the blob key.
+func (c DBService) loadPhotoImage(ctx context.Context, key string) (image.Image, error) {
+	blob, err := c.Blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return decodeImage(io.LimitReader(blob, maxImageUploadBytes))
+}
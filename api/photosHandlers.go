@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storedPhotoTypes are the content types photos are accepted in, matching
+// the formats decodeImage understands.
+var storedPhotoTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// readPhotoUpload reads the multipart "image" field and computes the
+// fingerprints of the image.
+func readPhotoUpload(w http.ResponseWriter, r *http.Request) (photoUpload, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadBytes)
+	if err := r.ParseMultipartForm(maxImageUploadBytes); err != nil {
+		return photoUpload{}, fmt.Errorf("parse multipart form: %w", err)
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return photoUpload{}, fmt.Errorf("read image field: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return photoUpload{}, fmt.Errorf("read image field: %w", err)
+	}
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(storedPhotoTypes, contentType) {
+		return photoUpload{}, fmt.Errorf("image must be one of %s", strings.Join(storedPhotoTypes, ", "))
+	}
+
+	img, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return photoUpload{}, err
+	}
+	fingerprints, err := computeFingerprints(img)
+	if err != nil {
+		return photoUpload{}, err
+	}
+	return photoUpload{Data: data, ContentType: contentType, Image: img, Fingerprints: fingerprints}, nil
+}
+
+// createItemPhotoHandler serves POST /api/items/{id}/photo, which replaces the
+// primary photo of the item with the multipart "image" field and responds
+// with the updated item.
+func createItemPhotoHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		upload, err := readPhotoUpload(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Uploading to a remote blob store takes longer than a query
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		_, err = d.SetItemPhoto(id, catalogId, upload, ctx)
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with storing the photo", http.StatusInternalServerError)
+			return
+		}
+
+		item, err := d.GetItem(id, catalogId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the item", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+	}
+}
+
+// createItemPhotosHandler serves /api/items/{id}/photos: GET lists the photos
+// of the item, POST adds the multipart "image" field as its last photo (the
+// primary one with ?primary=true) and PATCH takes PatchItemPhotosPayload.
+// All of them respond with the photos of the item.
+func createItemPhotosHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		status := http.StatusOK
+		switch r.Method {
+		case "GET":
+		case "POST":
+			upload, err := readPhotoUpload(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, err = d.AddItemPhoto(id, catalogId, upload, r.URL.Query().Get("primary") == "true", ctx)
+			if errors.Is(err, errItemNotFound) {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with storing the photo", http.StatusInternalServerError)
+				return
+			}
+			status = http.StatusCreated
+		case "PATCH":
+			var payload PatchItemPhotosPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			err := d.UpdateItemPhotos(id, catalogId, payload, ctx)
+			if errors.Is(err, errItemNotFound) {
+				http.Error(w, "Item not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errInvalidPhotoOrder) || errors.Is(err, errPhotoNotFound) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with updating the photos", http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		photos, err := d.GetItemPhotos(id, catalogId, ctx)
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the photos", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(photos)
+	}
+}
+
+// createPhotosResourceHandler serves GET /api/photos/{id}?size=thumb|medium|full
+// with a variant of the photo of the session's catalog, full when no size is
+// given. Originals are never served as they may carry metadata. DELETE
+// removes the photo from its item.
+func createPhotosResourceHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method == "DELETE" {
+			ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+			defer cancel()
+
+			err := d.DeletePhoto(id, catalogId, ctx)
+			if errors.Is(err, errPhotoNotFound) || errors.Is(err, errItemNotFound) {
+				http.Error(w, "Photo not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with deleting the photo", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		size := r.URL.Query().Get("size")
+		if size == "" {
+			size = PhotoSizeFull
+		}
+		if _, ok := photoSizes[size]; !ok {
+			http.Error(w, "Query parameter 'size' must be one of thumb, medium, full", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		photo, err := d.GetPhoto(id, catalogId, ctx)
+		if errors.Is(err, errPhotoNotFound) {
+			http.Error(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the photo", http.StatusInternalServerError)
+			return
+		}
+
+		// Variants never change, so the browser may keep them for good; it
+		// must not share them though, access depends on the session.
+		etag := photoVariantETag(photo, size)
+		setCacheHeaders := func() {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.Header().Del("Content-Type")
+			setCacheHeaders()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		variant, err := d.getPhotoVariant(ctx, photo, size)
+		if errors.Is(err, errBlobNotFound) {
+			http.Error(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the photo", http.StatusInternalServerError)
+			return
+		}
+
+		setCacheHeaders()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(variant)))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(variant)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errQuantityBelowZero = errors.New("quantity can't go below zero")
+
+// QuantityChange is an entry of an item's quantity history.
+type QuantityChange struct {
+	Delta     int       `json:"delta"`
+	Quantity  int       `json:"quantity"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ItemQuantity struct {
+	Quantity int              `json:"quantity"`
+	History  []QuantityChange `json:"history"`
+}
+
+func recordQuantityChange(ctx context.Context, tx *sql.Tx, itemId int64, delta int, quantity int) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO item_quantity_changes(item_id, delta, quantity) VALUES ($1, $2, $3)", itemId, delta, quantity)
+	if err != nil {
+		return fmt.Errorf("recordQuantityChange: %w", err)
+	}
+	return nil
+}
+
+// ChangeItemQuantity adds delta (which may be negative) to the quantity of the
+// item and records the change. The update is a single statement so that
+// concurrent scans of the same item all count.
+func (c DBService) ChangeItemQuantity(itemId int, catalogId int, delta int, ctx context.Context) (int, error) {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("ChangeItemQuantity begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var quantity int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE items SET quantity = quantity + $1, updated_at = now()
+		WHERE id = $2 AND catalog_id = $3 AND deleted_at IS NULL AND quantity + $1 >= 0
+		RETURNING quantity
+	`, delta, itemId, catalogId).Scan(&quantity)
+	if err == sql.ErrNoRows {
+		var exists bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL)", itemId, catalogId).Scan(&exists)
+		if err != nil {
+			return 0, fmt.Errorf("ChangeItemQuantity verify item: %w", err)
+		}
+		if !exists {
+			return 0, fmt.Errorf("ChangeItemQuantity %d: %w", itemId, errItemNotFound)
+		}
+		return 0, fmt.Errorf("ChangeItemQuantity %d by %d: %w", itemId, delta, errQuantityBelowZero)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ChangeItemQuantity update: %w", err)
+	}
+
+	if err := recordQuantityChange(ctx, tx, int64(itemId), delta, quantity); err != nil {
+		return 0, fmt.Errorf("ChangeItemQuantity: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ChangeItemQuantity commit: %w", err)
+	}
+	return quantity, nil
+}
+
+// GetItemQuantity returns the quantity of the item with its history, newest
+// change first.
+func (c DBService) GetItemQuantity(itemId int, catalogId int) (ItemQuantity, error) {
+	q := ItemQuantity{History: []QuantityChange{}}
+	err := c.DB.QueryRow("SELECT quantity FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NULL", itemId, catalogId).Scan(&q.Quantity)
+	if err == sql.ErrNoRows {
+		return ItemQuantity{}, fmt.Errorf("GetItemQuantity %d: %w", itemId, errItemNotFound)
+	}
+	if err != nil {
+		return ItemQuantity{}, fmt.Errorf("GetItemQuantity: %w", err)
+	}
+
+	result, err := c.DB.Query(`
+		SELECT delta, quantity, created_at
+		FROM item_quantity_changes
+		WHERE item_id = $1
+		ORDER BY id DESC
+	`, itemId)
+	if err != nil {
+		return ItemQuantity{}, fmt.Errorf("GetItemQuantity history: %w", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var change QuantityChange
+		if err := result.Scan(&change.Delta, &change.Quantity, &change.CreatedAt); err != nil {
+			return ItemQuantity{}, fmt.Errorf("GetItemQuantity scan: %w", err)
+		}
+		q.History = append(q.History, change)
+	}
+	return q, result.Err()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	RehashStatusRunning = "running"
+	RehashStatusDone    = "done"
+
+	rehashBatchSize = 50
+)
+
+// RehashJob walks all items with a photo and recomputes their fingerprints
+// with the current hash algorithms. Its row is updated after every item so
+// that it can pick up where it stopped after a restart.
+type RehashJob struct {
+	Id         int        `json:"id"`
+	Status     string     `json:"status"`
+	Versions   string     `json:"versions"`
+	LastItemId int        `json:"lastItemId"`
+	Processed  int        `json:"processed"`
+	Failed     int        `json:"failed"`
+	LastError  string     `json:"lastError,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// currentHashVersions describes the algorithms a job computes, e.g.
+// "ahash:1,dhash:2,phash:1".
+func currentHashVersions() string {
+	parts := []string{}
+	for _, name := range []string{AlgorithmAHash, AlgorithmDHash, AlgorithmPHash} {
+		parts = append(parts, fmt.Sprintf("%s:%d", name, hashAlgorithms[name].Version))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c DBService) GetLatestRehashJob() (RehashJob, error) {
+	var job RehashJob
+	var lastError sql.NullString
+	var finishedAt sql.NullTime
+	err := c.DB.QueryRow(`
+		SELECT id, status, versions, last_item_id, processed, failed, last_error, started_at, updated_at, finished_at
+		FROM rehash_jobs
+		ORDER BY id DESC
+		LIMIT 1
+	`).Scan(&job.Id, &job.Status, &job.Versions, &job.LastItemId, &job.Processed, &job.Failed, &lastError, &job.StartedAt, &job.UpdatedAt, &finishedAt)
+	if err != nil {
+		return RehashJob{}, err
+	}
+	job.LastError = lastError.String
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, nil
+}
+
+func (c DBService) InsertRehashJob(versions string) (RehashJob, error) {
+	var id int
+	err := c.DB.QueryRow("INSERT INTO rehash_jobs(status, versions) VALUES ($1, $2) RETURNING id", RehashStatusRunning, versions).Scan(&id)
+	if err != nil {
+		return RehashJob{}, fmt.Errorf("InsertRehashJob: %w", err)
+	}
+	return c.GetLatestRehashJob()
+}
+
+func (c DBService) saveRehashProgress(job RehashJob) error {
+	var finishedAt sql.NullTime
+	if job.FinishedAt != nil {
+		finishedAt = sql.NullTime{Time: *job.FinishedAt, Valid: true}
+	}
+	_, err := c.DB.Exec(`
+		UPDATE rehash_jobs
+		SET status = $2, last_item_id = $3, processed = $4, failed = $5, last_error = NULLIF($6, ''), updated_at = now(), finished_at = $7
+		WHERE id = $1
+	`, job.Id, job.Status, job.LastItemId, job.Processed, job.Failed, job.LastError, finishedAt)
+	if err != nil {
+		return fmt.Errorf("saveRehashProgress: %w", err)
+	}
+	return nil
+}
+
+type rehashCandidate struct {
+	Id        int
+	CatalogId int
+	PhotoUrl  string
+	// BlobKey is set for photos kept in the blob store.
+	BlobKey string
+}
+
+func (c DBService) getRehashBatch(afterItemId int) ([]rehashCandidate, error) {
+	result, err := c.DB.Query(`
+		SELECT i.id, i.catalog_id, i.photo_url, coalesce(p.blob_key, '')
+		FROM items i
+		LEFT JOIN photos p ON p.id = i.photo_id
+		WHERE i.id > $1 AND i.catalog_id IS NOT NULL AND i.photo_url IS NOT NULL AND i.photo_url <> ''
+		ORDER BY i.id
+		LIMIT $2
+	`, afterItemId, rehashBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("getRehashBatch query: %w", err)
+	}
+	defer result.Close()
+
+	batch := []rehashCandidate{}
+	for result.Next() {
+		var candidate rehashCandidate
+		if err := result.Scan(&candidate.Id, &candidate.CatalogId, &candidate.PhotoUrl, &candidate.BlobKey); err != nil {
+			return nil, fmt.Errorf("getRehashBatch scan: %w", err)
+		}
+		batch = append(batch, candidate)
+	}
+	return batch, result.Err()
+}
+
+// withBrowserDHashes adds the browser's dHashes of an item to the
+// fingerprints the server computed for it. The two dHash versions are stored
+// side by side, told apart by the version in the primary key.
+func withBrowserDHashes(fingerprints []Fingerprint, browserHashes []int64) []Fingerprint {
+	kept := slices.DeleteFunc(slices.Clone(fingerprints), func(f Fingerprint) bool {
+		return f.Algorithm == AlgorithmDHash && f.Version == browserDHashVersion
+	})
+	for _, hash := range browserHashes {
+		kept = append(kept, Fingerprint{Algorithm: AlgorithmDHash, Version: browserDHashVersion, Hash: fingerprintToHex(hash)})
+	}
+	return kept
+}
+
+// ReplaceItemFingerprints stores freshly computed fingerprints of an item.
+// The browser's dHash can't be computed here and is kept, so that scans keep
+// finding the item. The legacy fingerprint columns hold that dHash and are
+// left alone.
+func (c DBService) ReplaceItemFingerprints(ctx context.Context, catalogId int, itemId int, fingerprints []Fingerprint) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("ReplaceItemFingerprints begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var trashed bool
+	err = tx.QueryRowContext(ctx, "SELECT deleted_at IS NOT NULL FROM items WHERE id = $1 AND catalog_id = $2", itemId, catalogId).Scan(&trashed)
+	if err != nil {
+		return fmt.Errorf("ReplaceItemFingerprints verify item: %w", err)
+	}
+
+	var browserHashes []int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT coalesce(array_agg(hash), '{}') FROM item_fingerprints
+		WHERE item_id = $1 AND algorithm = $2 AND version = $3
+	`, itemId, AlgorithmDHash, browserDHashVersion).Scan(pq.Array(&browserHashes))
+	if err != nil {
+		return fmt.Errorf("ReplaceItemFingerprints browser dHash: %w", err)
+	}
+	kept := withBrowserDHashes(fingerprints, browserHashes)
+	if err := storeFingerprints(ctx, tx, int64(itemId), kept); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplaceItemFingerprints commit: %w", err)
+	}
+	// Trashed items get back into the index when restored.
+	if !trashed {
+		c.indexFingerprints(catalogId, itemId, kept)
+	}
+	return nil
+}
+
+// RehashRunner makes sure at most one rehash job runs at a time.
+type RehashRunner struct {
+	d       DBService
+	mu      sync.Mutex
+	running bool
+}
+
+func NewRehashRunner(d DBService) *RehashRunner {
+	return &RehashRunner{d: d}
+}
+
+// Resume continues an interrupted job. Jobs only ever start through
+// POST /api/admin/rehash; one left unfinished by other algorithm versions than
+// the current ones is closed instead, as its results would be mixed.
+func (r *RehashRunner) Resume() error {
+	job, err := r.d.GetLatestRehashJob()
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Resume: %w", err)
+	}
+	if job.Status != RehashStatusRunning {
+		return nil
+	}
+	if job.Versions != currentHashVersions() {
+		now := time.Now()
+		job.Status = RehashStatusDone
+		job.FinishedAt = &now
+		job.LastError = fmt.Sprintf("stopped as the hash algorithms changed to %s", currentHashVersions())
+		if err := r.d.saveRehashProgress(job); err != nil {
+			return fmt.Errorf("Resume: %w", err)
+		}
+		log.Printf("Rehash job %d stopped as the hash algorithms changed, start a new one with POST /api/admin/rehash", job.Id)
+		return nil
+	}
+	r.launch(job)
+	return nil
+}
+
+var errRehashRunning = fmt.Errorf("a rehash job is already running")
+
+// Start begins a new job unless one is already running.
+func (r *RehashRunner) Start() (RehashJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return RehashJob{}, errRehashRunning
+	}
+
+	job, err := r.d.InsertRehashJob(currentHashVersions())
+	if err != nil {
+		return RehashJob{}, err
+	}
+	r.launchLocked(job)
+	return job, nil
+}
+
+func (r *RehashRunner) launch(job RehashJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.running {
+		r.launchLocked(job)
+	}
+}
+
+// launchLocked runs the job in the background; r.mu must be held.
+func (r *RehashRunner) launchLocked(job RehashJob) {
+	r.running = true
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			r.running = false
+			r.mu.Unlock()
+		}()
+		if err := r.run(job); err != nil {
+			log.Printf("Rehash job %d stopped: %s", job.Id, err)
+		}
+	}()
+}
+
+func (r *RehashRunner) run(job RehashJob) error {
+	log.Printf("Rehash job %d running from item %d with %s", job.Id, job.LastItemId, job.Versions)
+	for {
+		batch, err := r.d.getRehashBatch(job.LastItemId)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, candidate := range batch {
+			if err := r.rehashItem(candidate); err != nil {
+				job.Failed++
+				job.LastError = fmt.Sprintf("item %d: %s", candidate.Id, err)
+			} else {
+				job.Processed++
+			}
+			job.LastItemId = candidate.Id
+			if err := r.d.saveRehashProgress(job); err != nil {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	job.Status = RehashStatusDone
+	job.FinishedAt = &now
+	log.Printf("Rehash job %d done: %d processed, %d failed", job.Id, job.Processed, job.Failed)
+	return r.d.saveRehashProgress(job)
+}
+
+func (r *RehashRunner) rehashItem(candidate rehashCandidate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if candidate.BlobKey == "" {
+		img, err := fetchItemPhoto(ctx, candidate.PhotoUrl)
+		if err != nil {
+			return err
+		}
+		fingerprints, err := computeFingerprints(img)
+		if err != nil {
+			return err
+		}
+		return r.d.ReplaceItemFingerprints(ctx, candidate.CatalogId, candidate.Id, fingerprints)
+	}
+
+	// Every stored photo of the item is hashed, the primary one also for the item
+	photos, err := r.d.getItemPhotoBlobs(ctx, candidate.Id)
+	if err != nil {
+		return err
+	}
+	var primary []Fingerprint
+	for _, photo := range photos {
+		img, err := r.d.loadPhotoImage(ctx, photo.BlobKey)
+		if err != nil {
+			return err
+		}
+		fingerprints, err := computeFingerprints(img)
+		if err != nil {
+			return err
+		}
+		if err := r.d.ReplacePhotoFingerprints(ctx, photo.Id, fingerprints); err != nil {
+			return err
+		}
+		if photo.BlobKey == candidate.BlobKey {
+			primary = fingerprints
+		}
+	}
+	if primary == nil {
+		return fmt.Errorf("primary photo of item %d is gone", candidate.Id)
+	}
+	return r.d.ReplaceItemFingerprints(ctx, candidate.CatalogId, candidate.Id, primary)
+}
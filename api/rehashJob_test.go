@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestRehashKeepsBrowserDHash rehashes an item that already has the
+// browser's dHash: both dHash versions are kept, each kind of fingerprint
+// once, as the primary key of item_fingerprints demands.
+func TestRehashKeepsBrowserDHash(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 48))
+	for y := range 48 {
+		for x := range 64 {
+			img.SetGray(x, y, color.Gray{Y: uint8(x*4 ^ y*5)})
+		}
+	}
+	fingerprints, err := computeFingerprints(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browserHash := int64(0x0f0f_3c3c_5a5a_a5a5)
+
+	kept := withBrowserDHashes(fingerprints, []int64{browserHash})
+
+	kinds := map[hashKind]string{}
+	for _, f := range kept {
+		if _, ok := kinds[f.kind()]; ok {
+			t.Fatalf("%s v%d is stored twice: %v", f.Algorithm, f.Version, kept)
+		}
+		kinds[f.kind()] = f.Hash
+	}
+	if got := kinds[hashKind{Algorithm: AlgorithmDHash, Version: browserDHashVersion}]; got != fingerprintToHex(browserHash) {
+		t.Fatalf("browser dHash = %q, want %q", got, fingerprintToHex(browserHash))
+	}
+	dhash := hashAlgorithms[AlgorithmDHash]
+	if _, ok := kinds[hashKind{Algorithm: AlgorithmDHash, Version: dhash.Version}]; !ok {
+		t.Fatalf("server dHash missing: %v", kept)
+	}
+	if len(kept) != len(fingerprints)+1 {
+		t.Fatalf("kept %d fingerprints, want %d", len(kept), len(fingerprints)+1)
+	}
+}
+
+func TestRehashWithoutBrowserDHash(t *testing.T) {
+	fingerprints := []Fingerprint{{Algorithm: AlgorithmDHash, Version: 2, Hash: fingerprintToHex(1)}}
+	if kept := withBrowserDHashes(fingerprints, nil); len(kept) != 1 || kept[0] != fingerprints[0] {
+		t.Fatalf("kept = %v, want %v", kept, fingerprints)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// searchConfig is the text search configuration created by the migrations:
+// the simple dictionary behind unaccent, so "zolw" finds "żółw".
+const searchConfig = "deccolog_search"
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// searchVectorExpr builds an item's search vector from its name (weight A)
+// and the names of its tags (weight B).
+const searchVectorExpr = `
+	setweight(to_tsvector('` + searchConfig + `', i.name), 'A') ||
+	setweight(to_tsvector('` + searchConfig + `', coalesce((
+		SELECT string_agg(t.name, ' ')
+		FROM items_tags it INNER JOIN tags t ON t.id = it.tag_id
+		WHERE it.item_id = i.id
+	), '')), 'B')`
+
+// refreshSearchVectors recomputes the search vector of the given items. It has
+// to run whenever an item's name or tags change.
+func refreshSearchVectors(ctx context.Context, tx *sql.Tx, itemIds ...int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE items i SET search_vector = "+searchVectorExpr+" WHERE i.id = ANY($1)", pq.Array(itemIds))
+	if err != nil {
+		return fmt.Errorf("refreshSearchVectors: %w", err)
+	}
+	return nil
+}
+
+// buildPrefixTsQuery turns free text into a tsquery where every word has to
+// match the beginning of a word, e.g. "red car" becomes "red:* & car:*".
+// Anything but letters and digits separates words.
+func buildPrefixTsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, w+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// Matches are marked by ts_headline with control characters that are removed
+// from the names beforehand, so they can be told apart from the text once it
+// is escaped.
+const (
+	headlineStart   = "\x01"
+	headlineStop    = "\x02"
+	headlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop + ", HighlightAll=true"
+)
+
+var headlineMarks = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+// highlightHTML escapes a ts_headline result and wraps its matches in <mark>
+// tags.
+func highlightHTML(headline string) string {
+	return headlineMarks.Replace(html.EscapeString(headline))
+}
+
+// SearchHighlights are HTML: the escaped names with matches wrapped in <mark>
+// tags.
+type SearchHighlights struct {
+	Name string `json:"name"`
+	Tags string `json:"tags"`
+}
+
+type SearchResult struct {
+	Rank       float64          `json:"rank"`
+	Highlights SearchHighlights `json:"highlights"`
+	Item       Item             `json:"item"`
+}
+
+// SearchItems ranks the catalog's items by a full-text match of the query
+// against their names and tags.
+func (c DBService) SearchItems(catalogId int, q string, limit int) ([]SearchResult, error) {
+	tsQuery := buildPrefixTsQuery(q)
+	if tsQuery == "" {
+		return []SearchResult{}, nil
+	}
+
+	result, err := c.DB.Query(`
+		SELECT i.id, ts_rank(i.search_vector, q),
+			ts_headline('`+searchConfig+`', translate(i.name, chr(1) || chr(2), ''), q, $4),
+			ts_headline('`+searchConfig+`', translate(coalesce((
+				SELECT string_agg(t.name, ', ' ORDER BY t.name)
+				FROM items_tags it INNER JOIN tags t ON t.id = it.tag_id
+				WHERE it.item_id = i.id
+			), ''), chr(1) || chr(2), ''), q, $4)
+		FROM items i, to_tsquery('`+searchConfig+`', $2) q
+		WHERE i.catalog_id = $1 AND i.deleted_at IS NULL AND i.search_vector @@ q
+		ORDER BY 2 DESC, i.id
+		LIMIT $3
+	`, catalogId, tsQuery, limit, headlineOptions)
+	if err != nil {
+		return []SearchResult{}, fmt.Errorf("SearchItems query: %w", err)
+	}
+	defer result.Close()
+
+	var ids []int
+	found := make(map[int]SearchResult)
+	for result.Next() {
+		var id int
+		var r SearchResult
+		if err := result.Scan(&id, &r.Rank, &r.Highlights.Name, &r.Highlights.Tags); err != nil {
+			return []SearchResult{}, fmt.Errorf("SearchItems scan: %w", err)
+		}
+		r.Highlights.Name = highlightHTML(r.Highlights.Name)
+		r.Highlights.Tags = highlightHTML(r.Highlights.Tags)
+		ids = append(ids, id)
+		found[id] = r
+	}
+	if err := result.Err(); err != nil {
+		return []SearchResult{}, fmt.Errorf("SearchItems rows: %w", err)
+	}
+	if len(ids) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	items, err := c.getItemsByIds(catalogId, ids)
+	if err != nil {
+		return []SearchResult{}, fmt.Errorf("SearchItems items: %w", err)
+	}
+	itemsById := make(map[int]Item, len(items))
+	for _, item := range items {
+		itemsById[item.Id] = item
+	}
+
+	results := make([]SearchResult, 0, len(ids))
+	for _, id := range ids {
+		item, ok := itemsById[id]
+		if !ok {
+			continue
+		}
+		r := found[id]
+		r.Item = item
+		results = append(results, r)
+	}
+	return results, nil
+}
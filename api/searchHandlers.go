@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func createSearchHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
+			return
+		}
+
+		limit, err := parseIntParam(r, "limit", defaultSearchLimit)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			http.Error(w, fmt.Sprintf("Query parameter 'limit' must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+
+		results, err := d.SearchItems(catalogId, q, limit)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with searching items", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(results)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultSimilarMaxDistance = 10
+	defaultSimilarLimit       = 20
+	maxSimilarLimit           = 200
+)
+
+// parseIntParam reads an integer query parameter, falling back when it's missing.
+func parseIntParam(r *http.Request, name string, fallback int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("query parameter '%s' must be an integer", name)
+	}
+	return v, nil
+}
+
+// similarityQueriesFromRequest collects the fingerprints to search by. GET takes
+// hex hashes as query parameters: "fingerprint" is the browser's dHash and
+// "ahash", "dhash" and "phash" are hashes computed like the server does.
+// POST takes a multipart "image" and computes every fingerprint from it.
+func similarityQueriesFromRequest(w http.ResponseWriter, r *http.Request) ([]fingerprintQuery, error) {
+	weights, err := parseHashWeights(r.URL.Query().Get("weights"))
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := []Fingerprint{}
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImageUploadBytes)
+		if err := r.ParseMultipartForm(maxImageUploadBytes); err != nil {
+			return nil, fmt.Errorf("parse multipart form: %w", err)
+		}
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			return nil, fmt.Errorf("read image field: %w", err)
+		}
+		defer file.Close()
+
+		img, err := decodeImage(file)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprints, err = computeFingerprints(img); err != nil {
+			return nil, err
+		}
+	} else {
+		if hash := r.URL.Query().Get("fingerprint"); hash != "" {
+			fingerprints = append(fingerprints, Fingerprint{Algorithm: AlgorithmDHash, Version: browserDHashVersion, Hash: hash})
+		}
+		for _, name := range []string{AlgorithmAHash, AlgorithmDHash, AlgorithmPHash} {
+			if hash := r.URL.Query().Get(name); hash != "" {
+				fingerprints = append(fingerprints, Fingerprint{Algorithm: name, Version: hashAlgorithms[name].Version, Hash: hash})
+			}
+		}
+	}
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("query parameter 'fingerprint' is required")
+	}
+
+	return queriesForFingerprints(fingerprints, weights)
+}
+
+func createSimilarItemsHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method != "GET" && r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		queries, err := similarityQueriesFromRequest(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		maxDistance, err := parseIntParam(r, "maxDistance", defaultSimilarMaxDistance)
+		if err != nil || maxDistance < 0 || maxDistance > HashBits {
+			http.Error(w, fmt.Sprintf("Query parameter 'maxDistance' must be between 0 and %d", HashBits), http.StatusBadRequest)
+			return
+		}
+
+		limit, err := parseIntParam(r, "limit", defaultSimilarLimit)
+		if err != nil || limit < 1 || limit > maxSimilarLimit {
+			http.Error(w, fmt.Sprintf("Query parameter 'limit' must be between 1 and %d", maxSimilarLimit), http.StatusBadRequest)
+			return
+		}
+
+		similar, err := d.FindSimilarItems(catalogId, queries, maxDistance, limit)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with finding similar items", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(similar)
+	}
+}
+
+func createDuplicatesHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		maxDistance, err := parseIntParam(r, "maxDistance", defaultDuplicateMaxDistance)
+		if err != nil || maxDistance < 0 || maxDistance > HashBits {
+			http.Error(w, fmt.Sprintf("Query parameter 'maxDistance' must be between 0 and %d", HashBits), http.StatusBadRequest)
+			return
+		}
+
+		clusters, err := d.FindDuplicateClusters(catalogId, maxDistance)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with finding duplicates", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(clusters)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var errTagCycle = errors.New("tag can't be placed under itself or its descendants")
+
+func nullableId(id sql.NullInt64) *int64 {
+	if !id.Valid {
+		return nil
+	}
+	return &id.Int64
+}
+
+// lockTagTree serializes changes to the catalog's tag tree until the
+// transaction ends, so that two concurrent moves can't close a cycle.
+func lockTagTree(ctx context.Context, tx *sql.Tx, catalogId int) error {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('tag_tree'), $1)", catalogId); err != nil {
+		return fmt.Errorf("lockTagTree: %w", err)
+	}
+	return nil
+}
+
+// tagAncestors returns the tag and every tag above it.
+func tagAncestors(ctx context.Context, tx *sql.Tx, tagId int) (map[int]bool, error) {
+	result, err := tx.QueryContext(ctx, `
+		WITH RECURSIVE a(id, parent_id) AS (
+			SELECT id, parent_id FROM tags WHERE id = $1
+			UNION
+			SELECT t.id, t.parent_id FROM tags t INNER JOIN a ON t.id = a.parent_id
+		)
+		SELECT id FROM a
+	`, tagId)
+	if err != nil {
+		return nil, fmt.Errorf("tagAncestors query: %w", err)
+	}
+	defer result.Close()
+
+	ancestors := make(map[int]bool)
+	for result.Next() {
+		var id int
+		if err := result.Scan(&id); err != nil {
+			return nil, fmt.Errorf("tagAncestors scan: %w", err)
+		}
+		ancestors[id] = true
+	}
+	return ancestors, result.Err()
+}
+
+// verifyTagParent makes sure the parent is a tag of the catalog that isn't
+// the tag itself or one of its descendants.
+func verifyTagParent(ctx context.Context, tx *sql.Tx, tagId int, parentId int, catalogId int) error {
+	if err := lockTagTree(ctx, tx, catalogId); err != nil {
+		return err
+	}
+
+	var existingParentId int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE id = $1 AND catalog_id = $2", parentId, catalogId).Scan(&existingParentId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("parent tag %d: %w", parentId, errTagNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("verifyTagParent lookup: %w", err)
+	}
+
+	ancestors, err := tagAncestors(ctx, tx, parentId)
+	if err != nil {
+		return fmt.Errorf("verifyTagParent: %w", err)
+	}
+	if ancestors[tagId] {
+		return fmt.Errorf("tag %d under %d: %w", tagId, parentId, errTagCycle)
+	}
+	return nil
+}
+
+type TagTreeNode struct {
+	TagUsage
+	Children []*TagTreeNode `json:"children"`
+}
+
+// GetTagTree returns the catalog's tags arranged under their parents, each
+// level sorted by name.
+func (c DBService) GetTagTree(catalogId int) ([]*TagTreeNode, error) {
+	result, err := c.DB.Query(`
+		SELECT t.id, t.name, t.parent_id, `+tagUsageExpr+`
+		FROM tags t
+		WHERE t.catalog_id = $1
+		ORDER BY t.name, t.id
+	`, catalogId)
+	if err != nil {
+		return nil, fmt.Errorf("GetTagTree query: %w", err)
+	}
+	defer result.Close()
+
+	nodes := []*TagTreeNode{}
+	byId := make(map[int64]*TagTreeNode)
+	for result.Next() {
+		node := &TagTreeNode{Children: []*TagTreeNode{}}
+		var parentId sql.NullInt64
+		if err := result.Scan(&node.Id, &node.Name, &parentId, &node.Count); err != nil {
+			return nil, fmt.Errorf("GetTagTree scan: %w", err)
+		}
+		node.ParentId = nullableId(parentId)
+		nodes = append(nodes, node)
+		byId[node.Id] = node
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("GetTagTree rows: %w", err)
+	}
+
+	roots := []*TagTreeNode{}
+	for _, node := range nodes {
+		if node.ParentId != nil {
+			if parent, ok := byId[*node.ParentId]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots, nil
+}
+
+// tagSubtrees maps each of the tags to itself and all of its descendants.
+func (c DBService) tagSubtrees(catalogId int, tagIds []int) (map[int][]int, error) {
+	subtrees := make(map[int][]int)
+	if len(tagIds) == 0 {
+		return subtrees, nil
+	}
+
+	result, err := c.DB.Query(`
+		WITH RECURSIVE d(root, id) AS (
+			SELECT id, id FROM tags WHERE id = ANY($1) AND catalog_id = $2
+			UNION
+			SELECT d.root, t.id FROM tags t INNER JOIN d ON t.parent_id = d.id
+		)
+		SELECT root, id FROM d
+	`, pq.Array(distinctIds(tagIds)), catalogId)
+	if err != nil {
+		return nil, fmt.Errorf("tagSubtrees query: %w", err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var root, id int
+		if err := result.Scan(&root, &id); err != nil {
+			return nil, fmt.Errorf("tagSubtrees scan: %w", err)
+		}
+		subtrees[root] = append(subtrees[root], id)
+	}
+	return subtrees, result.Err()
+}
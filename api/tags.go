@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errTagNameTaken    = errors.New("a tag with this name already exists in the catalog")
+	errTagInUse        = errors.New("tag is in use")
+	errInvalidTagMerge = errors.New("invalid tag merge")
+)
+
+// tagNameConstraint keeps tag names unique within a catalog.
+const tagNameConstraint = "tags_catalog_id_name_unique"
+
+// isUniqueViolation tells whether err comes from breaking the unique
+// constraint, e.g. when another request took the name in the meantime.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+// tagUsageExpr counts the items carrying tag t, leaving out trashed ones.
+const tagUsageExpr = "(SELECT count(*) FROM items_tags x INNER JOIN items i ON i.id = x.item_id WHERE x.tag_id = t.id AND i.deleted_at IS NULL)"
+
+// GetTag returns a tag of the catalog with the number of items carrying it.
+func (c DBService) GetTag(tagId int, catalogId int) (TagUsage, error) {
+	var tag TagUsage
+	var parentId sql.NullInt64
+	err := c.DB.QueryRow("SELECT t.id, t.name, t.parent_id, "+tagUsageExpr+" FROM tags t WHERE t.id = $1 AND t.catalog_id = $2", tagId, catalogId).Scan(&tag.Id, &tag.Name, &parentId, &tag.Count)
+	if err == sql.ErrNoRows {
+		return TagUsage{}, fmt.Errorf("GetTag %d: %w", tagId, errTagNotFound)
+	}
+	if err != nil {
+		return TagUsage{}, fmt.Errorf("GetTag: %w", err)
+	}
+	tag.ParentId = nullableId(parentId)
+	return tag, nil
+}
+
+// lockTag makes sure the tag belongs to the catalog and locks it until the
+// transaction ends.
+func lockTag(ctx context.Context, tx *sql.Tx, tagId int, catalogId int) error {
+	var existingTagId int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE id = $1 AND catalog_id = $2 FOR UPDATE", tagId, catalogId).Scan(&existingTagId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("tag %d: %w", tagId, errTagNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("lock tag: %w", err)
+	}
+	return nil
+}
+
+// taggedItemIds lists the items carrying any of the tags, so that their search
+// vectors can be refreshed after the tags change.
+func taggedItemIds(ctx context.Context, tx *sql.Tx, tagIds []int) ([]int, error) {
+	result, err := tx.QueryContext(ctx, "SELECT DISTINCT item_id FROM items_tags WHERE tag_id = ANY($1)", pq.Array(tagIds))
+	if err != nil {
+		return nil, fmt.Errorf("taggedItemIds query: %w", err)
+	}
+	defer result.Close()
+
+	ids := []int{}
+	for result.Next() {
+		var id int
+		if err := result.Scan(&id); err != nil {
+			return nil, fmt.Errorf("taggedItemIds scan: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, result.Err()
+}
+
+// UpdateTag renames the tag and/or moves it in the tag tree. A name another tag
+// of the catalog already has is rejected, and so is a parent that would make
+// the tag its own ancestor.
+func (c DBService) UpdateTag(tagId int, catalogId int, payload PatchTagPayload, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("UpdateTag begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockTag(ctx, tx, tagId, catalogId); err != nil {
+		return fmt.Errorf("UpdateTag: %w", err)
+	}
+
+	if payload.Name != nil {
+		var taken bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM tags WHERE catalog_id = $1 AND name = $2 AND id <> $3)", catalogId, *payload.Name, tagId).Scan(&taken)
+		if err != nil {
+			return fmt.Errorf("UpdateTag check name: %w", err)
+		}
+		if taken {
+			return fmt.Errorf("UpdateTag %q: %w", *payload.Name, errTagNameTaken)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE tags SET name = $1 WHERE id = $2", *payload.Name, tagId)
+		if isUniqueViolation(err, tagNameConstraint) {
+			return fmt.Errorf("UpdateTag %q: %w", *payload.Name, errTagNameTaken)
+		}
+		if err != nil {
+			return fmt.Errorf("UpdateTag name: %w", err)
+		}
+
+		itemIds, err := taggedItemIds(ctx, tx, []int{tagId})
+		if err != nil {
+			return fmt.Errorf("UpdateTag: %w", err)
+		}
+		if err := refreshSearchVectors(ctx, tx, itemIds...); err != nil {
+			return fmt.Errorf("UpdateTag: %w", err)
+		}
+	}
+
+	if payload.ParentId != nil {
+		var parentId *int64
+		if *payload.ParentId != 0 {
+			parentId = payload.ParentId
+			if err := verifyTagParent(ctx, tx, tagId, int(*parentId), catalogId); err != nil {
+				return fmt.Errorf("UpdateTag: %w", err)
+			}
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE tags SET parent_id = $1 WHERE id = $2", parentId, tagId); err != nil {
+			return fmt.Errorf("UpdateTag parent: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateTag commit: %w", err)
+	}
+	return nil
+}
+
+// DeleteTag removes the tag from all items and deletes it, moving its child
+// tags up to its parent. Unless force is set, a tag still carried by items
+// that aren't in the trash is kept and errTagInUse is returned.
+func (c DBService) DeleteTag(tagId int, catalogId int, force bool, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("DeleteTag begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockTag(ctx, tx, tagId, catalogId); err != nil {
+		return fmt.Errorf("DeleteTag: %w", err)
+	}
+
+	if !force {
+		var count int
+		if err := tx.QueryRowContext(ctx, "SELECT "+tagUsageExpr+" FROM tags t WHERE t.id = $1", tagId).Scan(&count); err != nil {
+			return fmt.Errorf("DeleteTag count: %w", err)
+		}
+		if count > 0 {
+			return fmt.Errorf("DeleteTag %d used by %d items: %w", tagId, count, errTagInUse)
+		}
+	}
+
+	itemIds, err := taggedItemIds(ctx, tx, []int{tagId})
+	if err != nil {
+		return fmt.Errorf("DeleteTag: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM items_tags WHERE tag_id = $1", tagId); err != nil {
+		return fmt.Errorf("DeleteTag delete links: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE tags SET parent_id = (SELECT parent_id FROM tags WHERE id = $1) WHERE parent_id = $1", tagId); err != nil {
+		return fmt.Errorf("DeleteTag move children: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id = $1", tagId); err != nil {
+		return fmt.Errorf("DeleteTag delete tag: %w", err)
+	}
+	if err := refreshSearchVectors(ctx, tx, itemIds...); err != nil {
+		return fmt.Errorf("DeleteTag: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("DeleteTag commit: %w", err)
+	}
+	return nil
+}
+
+type MergeTagsPayload struct {
+	SourceIds []int `json:"sourceIds"`
+}
+
+// MergeTags moves the items and child tags of the source tags over to the
+// target tag and deletes the sources. All tags must belong to the catalog, and
+// the target can't be a descendant of a source.
+func (c DBService) MergeTags(targetId int, catalogId int, sourceIds []int, ctx context.Context) error {
+	if len(sourceIds) == 0 {
+		return fmt.Errorf("no source tags given: %w", errInvalidTagMerge)
+	}
+	ids := append([]int{targetId}, sourceIds...)
+	sort.Ints(ids)
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			return fmt.Errorf("tag %d is listed more than once: %w", ids[i], errInvalidTagMerge)
+		}
+	}
+
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("MergeTags begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the tags in a stable order so concurrent merges can't deadlock
+	for _, id := range ids {
+		if err := lockTag(ctx, tx, id, catalogId); err != nil {
+			return fmt.Errorf("MergeTags: %w", err)
+		}
+	}
+
+	if err := lockTagTree(ctx, tx, catalogId); err != nil {
+		return fmt.Errorf("MergeTags: %w", err)
+	}
+	ancestors, err := tagAncestors(ctx, tx, targetId)
+	if err != nil {
+		return fmt.Errorf("MergeTags: %w", err)
+	}
+	for _, id := range sourceIds {
+		if ancestors[id] {
+			return fmt.Errorf("tag %d can't be merged into its descendant %d: %w", id, targetId, errTagCycle)
+		}
+	}
+
+	itemIds, err := taggedItemIds(ctx, tx, sourceIds)
+	if err != nil {
+		return fmt.Errorf("MergeTags: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO items_tags(item_id, tag_id)
+		SELECT DISTINCT item_id, $1::integer FROM items_tags WHERE tag_id = ANY($2)
+		ON CONFLICT DO NOTHING
+	`, targetId, pq.Array(sourceIds))
+	if err != nil {
+		return fmt.Errorf("MergeTags move links: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM items_tags WHERE tag_id = ANY($1)", pq.Array(sourceIds)); err != nil {
+		return fmt.Errorf("MergeTags delete links: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE tags SET parent_id = $1 WHERE parent_id = ANY($2) AND NOT id = ANY($2)", targetId, pq.Array(sourceIds))
+	if err != nil {
+		return fmt.Errorf("MergeTags move children: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ANY($1)", pq.Array(sourceIds)); err != nil {
+		return fmt.Errorf("MergeTags delete tags: %w", err)
+	}
+	if err := refreshSearchVectors(ctx, tx, itemIds...); err != nil {
+		return fmt.Errorf("MergeTags: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("MergeTags commit: %w", err)
+	}
+	return nil
+}
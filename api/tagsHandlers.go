@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTagSuggestions = 10
+	maxTagSuggestions     = 50
 )
 
 func createTagsCollectionHandler(d DBService) CollectionRequestHandler {
@@ -21,11 +30,30 @@ func createTagsCollectionHandler(d DBService) CollectionRequestHandler {
 
 		query := r.URL.Query().Get("q")
 		if query == "" {
-			http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
+			// Without a search query, list every tag of the catalog
+			tagsQuery, err := parseTagsQuery(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			page, err := d.ListTags(catalogId, tagsQuery)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(page)
+			return
+		}
+
+		limit, err := parseIntParam(r, "limit", defaultTagSuggestions)
+		if err != nil || limit < 1 || limit > maxTagSuggestions {
+			http.Error(w, fmt.Sprintf("Query parameter 'limit' must be between 1 and %d", maxTagSuggestions), http.StatusBadRequest)
 			return
 		}
 
-		tags, err := d.GetTagsByQuery(catalogId, query)
+		tags, err := d.GetTagsByQuery(catalogId, query, limit)
 		if err != nil {
 			fmt.Println(err)
 			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
@@ -37,26 +65,204 @@ func createTagsCollectionHandler(d DBService) CollectionRequestHandler {
 	}
 }
 
+type PatchTagPayload struct {
+	Name *string `json:"name"`
+	// ParentId moves the tag under another tag, 0 moves it to the top level.
+	ParentId *int64 `json:"parentId"`
+}
+
 func createTagsResourceHandler(d DBService) ResourceRequestHandler {
 	return func(w http.ResponseWriter, r *http.Request, catalogId, id int) {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		if r.Method == "GET" {
+			tag, err := d.GetTag(id, catalogId)
+			if errors.Is(err, errTagNotFound) {
+				http.Error(w, "Tag not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the tag", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(tag)
+			return
+		}
+
+		if r.Method == "PATCH" {
+			var payload PatchTagPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if payload.Name != nil {
+				name := strings.TrimSpace(*payload.Name)
+				if name == "" {
+					http.Error(w, "Tag name can't be empty", http.StatusBadRequest)
+					return
+				}
+				payload.Name = &name
+			}
+
+			err := d.UpdateTag(id, catalogId, payload, ctx)
+			if errors.Is(err, errTagNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errTagNameTaken) {
+				http.Error(w, "A tag with this name already exists", http.StatusConflict)
+				return
+			}
+			if errors.Is(err, errTagCycle) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with updating the tag", http.StatusInternalServerError)
+				return
+			}
+
+			tag, err := d.GetTag(id, catalogId)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with getting the tag", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(tag)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			// A tag still on items is only deleted with ?force=true
+			force := r.URL.Query().Get("force") == "true"
+			err := d.DeleteTag(id, catalogId, force, ctx)
+			if errors.Is(err, errTagNotFound) {
+				http.Error(w, "Tag not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, errTagInUse) {
+				http.Error(w, "Tag is still used by items, pass force=true to remove it from them", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "There was a problem with deleting the tag", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createMergeTagsHandler merges the tags listed in the body into the tag of
+// the path.
+func createMergeTagsHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		var payload MergeTagsPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		err := d.MergeTags(id, catalogId, payload.SourceIds, ctx)
+		if errors.Is(err, errInvalidTagMerge) || errors.Is(err, errTagCycle) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errTagNotFound) {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with merging the tags", http.StatusInternalServerError)
+			return
+		}
 
+		tag, err := d.GetTag(id, catalogId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the merged tag", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(tag)
 	}
 }
 
+type PostNewTagPayload struct {
+	Name     string `json:"name"`
+	ParentId *int64 `json:"parentId"`
+}
+
+// createTagHandler takes either the bare tag name as the body or, with a JSON
+// content type, a PostNewTagPayload.
 func createTagHandler(w http.ResponseWriter, r *http.Request, catalogId int, d DBService) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
-	tagName := string(body)
+	payload := PostNewTagPayload{Name: string(body)}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		payload = PostNewTagPayload{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
 
-	id, err := d.InsertNewTag(catalogId, tagName)
+	id, err := d.InsertNewTag(catalogId, payload.Name, payload.ParentId)
+	if errors.Is(err, errTagNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errTagNameTaken) {
+		http.Error(w, "A tag with this name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not create a tag", http.StatusInternalServerError)
+		return
+	}
+
+	tag, err := d.GetTag(int(id), catalogId)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Could not create a tag", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(TagItem{id, tagName})
+	json.NewEncoder(w).Encode(tag.TagItem)
+}
+
+func createTagTreeHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tree, err := d.GetTagTree(catalogId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(tree)
+	}
 }
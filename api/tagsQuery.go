@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+const (
+	defaultTagsPageSize = 100
+	maxTagsPageSize     = 1000
+)
+
+var tagsSortOptions = map[string]sortOption{
+	"name":  {Expr: "t.name", Type: "text"},
+	"count": {Expr: tagUsageExpr, Type: "bigint"},
+}
+
+// TagsQuery describes one page of GET /api/tags without a search query.
+type TagsQuery struct {
+	Limit      int
+	Cursor     *pageCursor
+	Sort       string
+	Descending bool
+}
+
+type TagsPage struct {
+	Tags       []TagUsage `json:"tags"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	Total      int        `json:"total"`
+}
+
+func parseTagsQuery(r *http.Request) (TagsQuery, error) {
+	params := r.URL.Query()
+	q := TagsQuery{Sort: "name"}
+
+	limit, err := parseIntParam(r, "limit", defaultTagsPageSize)
+	if err != nil || limit < 1 || limit > maxTagsPageSize {
+		return TagsQuery{}, fmt.Errorf("query parameter 'limit' must be between 1 and %d", maxTagsPageSize)
+	}
+	q.Limit = limit
+
+	if sort := params.Get("sort"); sort != "" {
+		if _, ok := tagsSortOptions[sort]; !ok {
+			return TagsQuery{}, fmt.Errorf("query parameter 'sort' must be one of name, count")
+		}
+		q.Sort = sort
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return TagsQuery{}, fmt.Errorf("query parameter 'order' must be asc or desc")
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		c, err := decodePageCursor(cursor)
+		if err != nil {
+			return TagsQuery{}, err
+		}
+		if c.Sort != q.Sort || c.Descending != q.Descending {
+			return TagsQuery{}, fmt.Errorf("cursor was made for another sort order")
+		}
+		q.Cursor = c
+	}
+
+	return q, nil
+}
+
+// ListTags returns one page of the catalog's tags with their usage counts,
+// together with the total number of tags.
+func (c DBService) ListTags(catalogId int, q TagsQuery) (TagsPage, error) {
+	conditions := &sqlConditions{}
+	conditions.where("t.catalog_id = " + conditions.arg(catalogId))
+
+	var total int
+	if err := c.DB.QueryRow("SELECT count(*) FROM tags t WHERE "+conditions.sql(), conditions.args...).Scan(&total); err != nil {
+		return TagsPage{}, fmt.Errorf("ListTags count: %w", err)
+	}
+
+	sort := tagsSortOptions[q.Sort]
+	direction, comparison := "ASC", ">"
+	if q.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if q.Cursor != nil {
+		conditions.where(fmt.Sprintf("(%s, t.id) %s (%s::%s, %s)",
+			sort.Expr, comparison, conditions.arg(q.Cursor.Key), sort.Type, conditions.arg(q.Cursor.Id)))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT t.id, t.name, t.parent_id, %s, (%s)::text
+		FROM tags t
+		WHERE %s
+		ORDER BY %s %s, t.id %s
+		LIMIT %s
+	`, tagUsageExpr, sort.Expr, conditions.sql(), sort.Expr, direction, direction, conditions.arg(q.Limit+1))
+	result, err := c.DB.Query(query, conditions.args...)
+	if err != nil {
+		return TagsPage{}, fmt.Errorf("ListTags query: %w", err)
+	}
+	defer result.Close()
+
+	page := TagsPage{Tags: []TagUsage{}, Total: total}
+	var keys []string
+	for result.Next() {
+		var tag TagUsage
+		var parentId sql.NullInt64
+		var key string
+		if err := result.Scan(&tag.Id, &tag.Name, &parentId, &tag.Count, &key); err != nil {
+			return TagsPage{}, fmt.Errorf("ListTags scan: %w", err)
+		}
+		tag.ParentId = nullableId(parentId)
+		page.Tags = append(page.Tags, tag)
+		keys = append(keys, key)
+	}
+	if err := result.Err(); err != nil {
+		return TagsPage{}, fmt.Errorf("ListTags rows: %w", err)
+	}
+
+	if len(page.Tags) > q.Limit {
+		page.Tags, keys = page.Tags[:q.Limit], keys[:q.Limit]
+		last := len(page.Tags) - 1
+		page.NextCursor = pageCursor{Sort: q.Sort, Descending: q.Descending, Key: keys[last], Id: int(page.Tags[last].Id)}.encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const trashPurgeInterval = time.Hour
+
+// trashRetention is how long trashed items are kept before they are purged,
+// TRASH_RETENTION_DAYS in the environment (30 by default).
+func trashRetention() time.Duration {
+	days, err := strconv.Atoi(getEnv("TRASH_RETENTION_DAYS", "30"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// GetTrashedItems lists the catalog's trashed items, most recently deleted first.
+func (c DBService) GetTrashedItems(catalogId int) ([]Item, error) {
+	query := itemsWithTagsQuery + `
+		WHERE i.catalog_id = $1 AND i.deleted_at IS NOT NULL
+		ORDER BY i.deleted_at DESC, i.id, t.name
+	`
+	result, err := c.DB.Query(query, catalogId)
+	if err != nil {
+		return []Item{}, fmt.Errorf("GetTrashedItems query: %w", err)
+	}
+	defer result.Close()
+
+	items, err := scanItemsWithTags(result)
+	if err != nil {
+		return []Item{}, fmt.Errorf("GetTrashedItems scan: %w", err)
+	}
+	if err := c.attachFingerprints(items); err != nil {
+		return []Item{}, err
+	}
+	if err := c.attachAttributes(items); err != nil {
+		return []Item{}, err
+	}
+	return items, nil
+}
+
+// RestoreItem takes the item out of the trash.
+func (c DBService) RestoreItem(itemId int, catalogId int, ctx context.Context) error {
+	result, err := c.DB.ExecContext(ctx, "UPDATE items SET deleted_at = NULL, updated_at = now() WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NOT NULL", itemId, catalogId)
+	if err != nil {
+		return fmt.Errorf("RestoreItem: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("RestoreItem: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("RestoreItem %d: %w", itemId, errItemNotFound)
+	}
+
+	item, err := c.GetItem(itemId, catalogId)
+	if err != nil {
+		return fmt.Errorf("RestoreItem reload: %w", err)
+	}
+	c.indexFingerprints(catalogId, itemId, item.Fingerprints)
+	return nil
+}
+
+// purgeItems removes the given items for good, with their tag links,
+// fingerprints and photos.
+func purgeItems(ctx context.Context, tx *sql.Tx, itemIds []int) error {
+	ids := pq.Array(itemIds)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM items_tags WHERE item_id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("purgeItems tags: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_fingerprints WHERE item_id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("purgeItems fingerprints: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_attributes WHERE item_id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("purgeItems attributes: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_quantity_changes WHERE item_id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("purgeItems quantity history: %w", err)
+	}
+
+	// Photos go with their items; their blobs are left to the photo collector.
+	var photoIds []int64
+	if err := tx.QueryRowContext(ctx, "SELECT coalesce(array_agg(photo_id), '{}') FROM item_photos WHERE item_id = ANY($1)", ids).Scan(pq.Array(&photoIds)); err != nil {
+		return fmt.Errorf("purgeItems photos: %w", err)
+	}
+	photos := pq.Array(photoIds)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photo_fingerprints WHERE photo_id = ANY($1)", photos); err != nil {
+		return fmt.Errorf("purgeItems photo fingerprints: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_photos WHERE item_id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("purgeItems item photos: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM items WHERE id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("purgeItems: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM photos WHERE id = ANY($1)", photos); err != nil {
+		return fmt.Errorf("purgeItems delete photos: %w", err)
+	}
+	return nil
+}
+
+// PurgeItem permanently deletes a trashed item of the catalog.
+func (c DBService) PurgeItem(itemId int, catalogId int, ctx context.Context) error {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("PurgeItem begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existingItemId int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM items WHERE id = $1 AND catalog_id = $2 AND deleted_at IS NOT NULL FOR UPDATE", itemId, catalogId).Scan(&existingItemId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("PurgeItem %d: %w", itemId, errItemNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("PurgeItem verify item: %w", err)
+	}
+
+	if err := purgeItems(ctx, tx, []int{itemId}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("PurgeItem commit: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpiredTrash permanently deletes items trashed before the cutoff.
+func (c DBService) PurgeExpiredTrash(cutoff time.Time, ctx context.Context) (int, error) {
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("PurgeExpiredTrash begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.QueryContext(ctx, "SELECT id FROM items WHERE deleted_at < $1 FOR UPDATE", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("PurgeExpiredTrash query: %w", err)
+	}
+	var ids []int
+	for result.Next() {
+		var id int
+		if err := result.Scan(&id); err != nil {
+			result.Close()
+			return 0, fmt.Errorf("PurgeExpiredTrash scan: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	result.Close()
+	if err := result.Err(); err != nil {
+		return 0, fmt.Errorf("PurgeExpiredTrash rows: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if err := purgeItems(ctx, tx, ids); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("PurgeExpiredTrash commit: %w", err)
+	}
+	return len(ids), nil
+}
+
+// startTrashPurger periodically purges items that stayed in the trash longer
+// than the retention period.
+func startTrashPurger(d DBService, retention time.Duration) {
+	purge := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		n, err := d.PurgeExpiredTrash(time.Now().Add(-retention), ctx)
+		if err != nil {
+			log.Printf("Error purging trash: %s", err)
+			return
+		}
+		if n > 0 {
+			log.Printf("Purged %d items from the trash", n)
+		}
+	}
+
+	go func() {
+		purge()
+		for range time.Tick(trashPurgeInterval) {
+			purge()
+		}
+	}()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func createTrashCollectionHandler(d DBService) CollectionRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		items, err := d.GetTrashedItems(catalogId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the trash", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(items)
+	}
+}
+
+func createTrashResourceHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		err := d.PurgeItem(id, catalogId, ctx)
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found in the trash", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with purging the item", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
+
+func createRestoreItemHandler(d DBService) ResourceRequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, catalogId int, id int) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		err := d.RestoreItem(id, catalogId, ctx)
+		if errors.Is(err, errItemNotFound) {
+			http.Error(w, "Item not found in the trash", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with restoring the item", http.StatusInternalServerError)
+			return
+		}
+
+		item, err := d.GetItem(id, catalogId)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "There was a problem with getting the item", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(item)
+	}
+}
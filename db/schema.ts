@@ -1,11 +1,27 @@
-import { bigint, integer, pgTable, primaryKey, serial, text, timestamp } from "drizzle-orm/pg-core";
+import { sql } from "drizzle-orm";
+import { type AnyPgColumn, bigint, boolean, check, customType, date, doublePrecision, index, integer, pgTable, primaryKey, serial, text, timestamp, unique } from "drizzle-orm/pg-core";
+
+const tsvector = customType<{ data: string }>({
+  dataType() {
+    return "tsvector";
+  },
+});
 
 export const catalog = pgTable("catalogs", {
   id: serial("id").primaryKey(),
-  name: text("name").notNull(),
+  name: text("name").notNull().unique(),
   password: text("password").notNull(),
 });
 
+export const photos = pgTable("photos", {
+  id: serial("id").primaryKey(),
+  catalogId: integer("catalog_id").notNull().references(() => catalog.id),
+  blobKey: text("blob_key").notNull().unique(),
+  contentType: text("content_type").notNull(),
+  size: integer("size").notNull(),
+  createdAt: timestamp("created_at").notNull().defaultNow(),
+});
+
 export const items = pgTable("items", {
   id: serial("id").primaryKey(),
   name: text("name").notNull(),
@@ -16,17 +32,103 @@ export const items = pgTable("items", {
   fingerprint: text("fingerprint").notNull(),
   fingerprint_bigint: bigint({ mode: "bigint" }),
   photoUrl: text("photo_url"),
-});
+  photoId: integer("photo_id").references(() => photos.id),
+  deletedAt: timestamp("deleted_at"),
+  searchVector: tsvector("search_vector"),
+  quantity: integer("quantity").notNull().default(1),
+  status: text("status").notNull().default("owned"),
+}, t => [
+  index("items_search_vector_idx").using("gin", t.searchVector),
+  index("items_catalog_id_status_idx").on(t.catalogId, t.status),
+  check("items_quantity_non_negative", sql`${t.quantity} >= 0`),
+  check("items_status_valid", sql`${t.status} IN ('owned', 'wanted', 'traded_away')`)
+]);
 
 export const tags = pgTable("tags", {
   id: serial("id").primaryKey(),
   name: text("name").notNull(),
   catalogId: integer("catalog_id").references(() => catalog.id),
-});
+  parentId: integer("parent_id").references((): AnyPgColumn => tags.id),
+}, t => [
+  index("tags_name_trgm_idx").using("gin", t.name.op("gin_trgm_ops")),
+  index("tags_parent_id_idx").on(t.parentId),
+  unique("tags_catalog_id_name_unique").on(t.catalogId, t.name)
+]);
 
 export const itemsTags = pgTable("items_tags", {
   itemId: integer("item_id").notNull().references(() => items.id),
   tagId: integer("tag_id").notNull().references(() => tags.id),
 }, t => [
   primaryKey({ columns: [t.itemId, t.tagId] })
-])
\ No newline at end of file
+])
+
+export const itemFingerprints = pgTable("item_fingerprints", {
+  itemId: integer("item_id").notNull().references(() => items.id),
+  algorithm: text("algorithm").notNull(),
+  version: integer("version").notNull(),
+  hash: bigint({ mode: "bigint" }).notNull(),
+}, t => [
+  primaryKey({ columns: [t.itemId, t.algorithm, t.version] })
+])
+
+export const itemPhotos = pgTable("item_photos", {
+  itemId: integer("item_id").notNull().references(() => items.id),
+  photoId: integer("photo_id").notNull().references(() => photos.id).unique(),
+  position: integer("position").notNull().default(0),
+}, t => [
+  primaryKey({ columns: [t.itemId, t.photoId] })
+])
+
+export const photoFingerprints = pgTable("photo_fingerprints", {
+  photoId: integer("photo_id").notNull().references(() => photos.id),
+  algorithm: text("algorithm").notNull(),
+  version: integer("version").notNull(),
+  hash: bigint({ mode: "bigint" }).notNull(),
+}, t => [
+  primaryKey({ columns: [t.photoId, t.algorithm, t.version] })
+])
+
+export const rehashJobs = pgTable("rehash_jobs", {
+  id: serial("id").primaryKey(),
+  status: text("status").notNull(),
+  versions: text("versions").notNull(),
+  lastItemId: integer("last_item_id").notNull().default(0),
+  processed: integer("processed").notNull().default(0),
+  failed: integer("failed").notNull().default(0),
+  lastError: text("last_error"),
+  startedAt: timestamp("started_at").notNull().defaultNow(),
+  updatedAt: timestamp("updated_at").notNull().defaultNow(),
+  finishedAt: timestamp("finished_at"),
+});
+export const attributeDefinitions = pgTable("attribute_definitions", {
+  id: serial("id").primaryKey(),
+  catalogId: integer("catalog_id").notNull().references(() => catalog.id),
+  key: text("key").notNull(),
+  label: text("label").notNull(),
+  type: text("type").notNull(),
+  options: text("options").array().notNull().default([]),
+  required: boolean("required").notNull().default(false),
+}, t => [
+  unique().on(t.catalogId, t.key)
+]);
+
+export const itemAttributes = pgTable("item_attributes", {
+  itemId: integer("item_id").notNull().references(() => items.id),
+  attributeId: integer("attribute_id").notNull().references(() => attributeDefinitions.id),
+  valueText: text("value_text"),
+  valueNumber: doublePrecision("value_number"),
+  valueDate: date("value_date"),
+  valueBool: boolean("value_bool"),
+}, t => [
+  primaryKey({ columns: [t.itemId, t.attributeId] })
+]);
+
+export const itemQuantityChanges = pgTable("item_quantity_changes", {
+  id: serial("id").primaryKey(),
+  itemId: integer("item_id").notNull().references(() => items.id),
+  delta: integer("delta").notNull(),
+  quantity: integer("quantity").notNull(),
+  createdAt: timestamp("created_at").notNull().defaultNow(),
+}, t => [
+  index("item_quantity_changes_item_id_idx").on(t.itemId)
+]);
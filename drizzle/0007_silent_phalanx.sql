@@ -0,0 +1,10 @@
+CREATE TABLE "item_fingerprints" (
+	"item_id" integer NOT NULL,
+	"algorithm" text NOT NULL,
+	"version" integer NOT NULL,
+	"hash" bigint NOT NULL,
+	CONSTRAINT "item_fingerprints_item_id_algorithm_pk" PRIMARY KEY("item_id","algorithm")
+);
+--> statement-breakpoint
+ALTER TABLE "item_fingerprints" ADD CONSTRAINT "item_fingerprints_item_id_items_id_fk" FOREIGN KEY ("item_id") REFERENCES "public"."items"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+INSERT INTO "item_fingerprints" ("item_id", "algorithm", "version", "hash") SELECT "id", 'dhash', 1, "fingerprint_bigint" FROM "items" WHERE "fingerprint_bigint" IS NOT NULL;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE "rehash_jobs" (
+	"id" serial PRIMARY KEY NOT NULL,
+	"status" text NOT NULL,
+	"versions" text NOT NULL,
+	"last_item_id" integer DEFAULT 0 NOT NULL,
+	"processed" integer DEFAULT 0 NOT NULL,
+	"failed" integer DEFAULT 0 NOT NULL,
+	"last_error" text,
+	"started_at" timestamp DEFAULT now() NOT NULL,
+	"updated_at" timestamp DEFAULT now() NOT NULL,
+	"finished_at" timestamp
+);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE "items" ADD COLUMN "deleted_at" timestamp;
\ No newline at end of file
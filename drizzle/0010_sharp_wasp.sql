@@ -0,0 +1,12 @@
+CREATE EXTENSION IF NOT EXISTS unaccent;--> statement-breakpoint
+CREATE TEXT SEARCH CONFIGURATION "public"."deccolog_search" (COPY = pg_catalog.simple);--> statement-breakpoint
+ALTER TEXT SEARCH CONFIGURATION "public"."deccolog_search" ALTER MAPPING FOR hword, hword_part, word WITH unaccent, simple;--> statement-breakpoint
+ALTER TABLE "items" ADD COLUMN "search_vector" "tsvector";--> statement-breakpoint
+CREATE INDEX "items_search_vector_idx" ON "items" USING gin ("search_vector");--> statement-breakpoint
+UPDATE "items" SET "search_vector" =
+	setweight(to_tsvector('deccolog_search', "items"."name"), 'A') ||
+	setweight(to_tsvector('deccolog_search', coalesce((
+		SELECT string_agg("tags"."name", ' ')
+		FROM "items_tags" INNER JOIN "tags" ON "tags"."id" = "items_tags"."tag_id"
+		WHERE "items_tags"."item_id" = "items"."id"
+	), '')), 'B');
\ No newline at end of file
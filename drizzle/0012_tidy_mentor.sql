@@ -0,0 +1,3 @@
+ALTER TABLE "tags" ADD COLUMN "parent_id" integer;--> statement-breakpoint
+ALTER TABLE "tags" ADD CONSTRAINT "tags_parent_id_tags_id_fk" FOREIGN KEY ("parent_id") REFERENCES "public"."tags"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+CREATE INDEX "tags_parent_id_idx" ON "tags" USING btree ("parent_id");
\ No newline at end of file
@@ -0,0 +1,24 @@
+CREATE TABLE "attribute_definitions" (
+	"id" serial PRIMARY KEY NOT NULL,
+	"catalog_id" integer NOT NULL,
+	"key" text NOT NULL,
+	"label" text NOT NULL,
+	"type" text NOT NULL,
+	"options" text[] DEFAULT '{}' NOT NULL,
+	"required" boolean DEFAULT false NOT NULL,
+	CONSTRAINT "attribute_definitions_catalog_id_key_unique" UNIQUE("catalog_id","key")
+);
+--> statement-breakpoint
+CREATE TABLE "item_attributes" (
+	"item_id" integer NOT NULL,
+	"attribute_id" integer NOT NULL,
+	"value_text" text,
+	"value_number" double precision,
+	"value_date" date,
+	"value_bool" boolean,
+	CONSTRAINT "item_attributes_item_id_attribute_id_pk" PRIMARY KEY("item_id","attribute_id")
+);
+--> statement-breakpoint
+ALTER TABLE "attribute_definitions" ADD CONSTRAINT "attribute_definitions_catalog_id_catalogs_id_fk" FOREIGN KEY ("catalog_id") REFERENCES "public"."catalogs"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+ALTER TABLE "item_attributes" ADD CONSTRAINT "item_attributes_item_id_items_id_fk" FOREIGN KEY ("item_id") REFERENCES "public"."items"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+ALTER TABLE "item_attributes" ADD CONSTRAINT "item_attributes_attribute_id_attribute_definitions_id_fk" FOREIGN KEY ("attribute_id") REFERENCES "public"."attribute_definitions"("id") ON DELETE no action ON UPDATE no action;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE "item_quantity_changes" (
+	"id" serial PRIMARY KEY NOT NULL,
+	"item_id" integer NOT NULL,
+	"delta" integer NOT NULL,
+	"quantity" integer NOT NULL,
+	"created_at" timestamp DEFAULT now() NOT NULL
+);
+--> statement-breakpoint
+ALTER TABLE "items" ADD COLUMN "quantity" integer DEFAULT 1 NOT NULL;--> statement-breakpoint
+ALTER TABLE "item_quantity_changes" ADD CONSTRAINT "item_quantity_changes_item_id_items_id_fk" FOREIGN KEY ("item_id") REFERENCES "public"."items"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+CREATE INDEX "item_quantity_changes_item_id_idx" ON "item_quantity_changes" USING btree ("item_id");--> statement-breakpoint
+ALTER TABLE "items" ADD CONSTRAINT "items_quantity_non_negative" CHECK ("items"."quantity" >= 0);
\ No newline at end of file
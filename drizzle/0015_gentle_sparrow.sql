@@ -0,0 +1,2 @@
+ALTER TABLE "items" ADD COLUMN "status" text DEFAULT 'owned' NOT NULL;--> statement-breakpoint
+CREATE INDEX "items_catalog_id_status_idx" ON "items" USING btree ("catalog_id","status");
\ No newline at end of file
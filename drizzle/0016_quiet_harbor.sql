@@ -0,0 +1,13 @@
+CREATE TABLE "photos" (
+	"id" serial PRIMARY KEY NOT NULL,
+	"catalog_id" integer NOT NULL,
+	"blob_key" text NOT NULL,
+	"content_type" text NOT NULL,
+	"size" integer NOT NULL,
+	"created_at" timestamp DEFAULT now() NOT NULL,
+	CONSTRAINT "photos_blob_key_unique" UNIQUE("blob_key")
+);
+--> statement-breakpoint
+ALTER TABLE "items" ADD COLUMN "photo_id" integer;--> statement-breakpoint
+ALTER TABLE "photos" ADD CONSTRAINT "photos_catalog_id_catalogs_id_fk" FOREIGN KEY ("catalog_id") REFERENCES "public"."catalogs"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+ALTER TABLE "items" ADD CONSTRAINT "items_photo_id_photos_id_fk" FOREIGN KEY ("photo_id") REFERENCES "public"."photos"("id") ON DELETE no action ON UPDATE no action;
\ No newline at end of file
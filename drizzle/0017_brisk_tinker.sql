@@ -0,0 +1,26 @@
+CREATE TABLE "item_photos" (
+	"item_id" integer NOT NULL,
+	"photo_id" integer NOT NULL,
+	"position" integer DEFAULT 0 NOT NULL,
+	CONSTRAINT "item_photos_item_id_photo_id_pk" PRIMARY KEY("item_id","photo_id"),
+	CONSTRAINT "item_photos_photo_id_unique" UNIQUE("photo_id")
+);
+--> statement-breakpoint
+CREATE TABLE "photo_fingerprints" (
+	"photo_id" integer NOT NULL,
+	"algorithm" text NOT NULL,
+	"version" integer NOT NULL,
+	"hash" bigint NOT NULL,
+	CONSTRAINT "photo_fingerprints_photo_id_algorithm_pk" PRIMARY KEY("photo_id","algorithm")
+);
+--> statement-breakpoint
+ALTER TABLE "item_photos" ADD CONSTRAINT "item_photos_item_id_items_id_fk" FOREIGN KEY ("item_id") REFERENCES "public"."items"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+ALTER TABLE "item_photos" ADD CONSTRAINT "item_photos_photo_id_photos_id_fk" FOREIGN KEY ("photo_id") REFERENCES "public"."photos"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+ALTER TABLE "photo_fingerprints" ADD CONSTRAINT "photo_fingerprints_photo_id_photos_id_fk" FOREIGN KEY ("photo_id") REFERENCES "public"."photos"("id") ON DELETE no action ON UPDATE no action;--> statement-breakpoint
+-- Photos stored so far are the primary photos of their items
+INSERT INTO "item_photos" ("item_id", "photo_id", "position")
+SELECT "id", "photo_id", 0 FROM "items" WHERE "photo_id" IS NOT NULL;--> statement-breakpoint
+INSERT INTO "photo_fingerprints" ("photo_id", "algorithm", "version", "hash")
+SELECT i."photo_id", f."algorithm", f."version", f."hash"
+FROM "items" i INNER JOIN "item_fingerprints" f ON f."item_id" = i."id"
+WHERE i."photo_id" IS NOT NULL;
\ No newline at end of file
@@ -0,0 +1,19 @@
+-- Catalogs are logged into by name, so names have to be unique. Catalogs sharing
+-- a name are not renamed behind their owners' backs: the migration stops and
+-- lists them, and an operator renames all but one of each, e.g.
+--   UPDATE "catalogs" SET "name" = 'Stamps 2' WHERE "id" = 5;
+-- and tells their owners the new name before running it again.
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('%L (ids %s)', "name", "ids"), ', ') INTO duplicates
+	FROM (
+		SELECT "name", string_agg("id"::text, ', ' ORDER BY "id") AS "ids"
+		FROM "catalogs" GROUP BY "name" HAVING count(*) > 1
+	) d;
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'catalog names are taken more than once, rename these catalogs first: %', duplicates;
+	END IF;
+END $$;--> statement-breakpoint
+ALTER TABLE "catalogs" ADD CONSTRAINT "catalogs_name_unique" UNIQUE("name");
\ No newline at end of file
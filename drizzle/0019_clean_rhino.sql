@@ -0,0 +1,13 @@
+-- Tags taken more than once in a catalog are merged into the oldest of them
+CREATE TEMPORARY TABLE "tag_duplicates" AS
+SELECT "id", "keep_id" FROM (
+	SELECT "id", min("id") OVER (PARTITION BY "catalog_id", "name") AS "keep_id" FROM "tags"
+) t WHERE "id" <> "keep_id";--> statement-breakpoint
+INSERT INTO "items_tags" ("item_id", "tag_id")
+SELECT it."item_id", d."keep_id" FROM "items_tags" it INNER JOIN "tag_duplicates" d ON d."id" = it."tag_id"
+ON CONFLICT DO NOTHING;--> statement-breakpoint
+DELETE FROM "items_tags" WHERE "tag_id" IN (SELECT "id" FROM "tag_duplicates");--> statement-breakpoint
+UPDATE "tags" t SET "parent_id" = nullif(d."keep_id", t."id") FROM "tag_duplicates" d WHERE t."parent_id" = d."id";--> statement-breakpoint
+DELETE FROM "tags" WHERE "id" IN (SELECT "id" FROM "tag_duplicates");--> statement-breakpoint
+DROP TABLE "tag_duplicates";--> statement-breakpoint
+ALTER TABLE "tags" ADD CONSTRAINT "tags_catalog_id_name_unique" UNIQUE("catalog_id","name");
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE "items" ADD CONSTRAINT "items_status_valid" CHECK ("items"."status" IN ('owned', 'wanted', 'traded_away'));
\ No newline at end of file
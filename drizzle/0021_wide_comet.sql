@@ -0,0 +1,6 @@
+-- Items keep the browser's dHash next to the one the server computes, so
+-- fingerprints are told apart by their version too
+ALTER TABLE "item_fingerprints" DROP CONSTRAINT "item_fingerprints_item_id_algorithm_pk";--> statement-breakpoint
+ALTER TABLE "item_fingerprints" ADD CONSTRAINT "item_fingerprints_item_id_algorithm_version_pk" PRIMARY KEY("item_id","algorithm","version");--> statement-breakpoint
+ALTER TABLE "photo_fingerprints" DROP CONSTRAINT "photo_fingerprints_photo_id_algorithm_pk";--> statement-breakpoint
+ALTER TABLE "photo_fingerprints" ADD CONSTRAINT "photo_fingerprints_photo_id_algorithm_version_pk" PRIMARY KEY("photo_id","algorithm","version");
\ No newline at end of file
@@ -3,7 +3,11 @@ module mk/deccolog
 go 1.25.4
 
 require (
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.54.0
+	golang.org/x/image v0.25.0
 )
+
+require golang.org/x/sys v0.47.0 // indirect
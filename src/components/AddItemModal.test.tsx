@@ -14,7 +14,7 @@ vi.mock('@/hooks/useCamera', () => ({
 }))
 
 vi.mock('@/hooks/useUploader', () => ({
-  useUploader: vi.fn(() => ({ uploadDataUrl: vi.fn().mockResolvedValue(null) }))
+  useUploader: vi.fn(() => ({ uploadItemPhoto: vi.fn().mockResolvedValue({ success: true }) }))
 }))
 
 vi.mock('@/hooks/useImageProcessing', () => ({
@@ -293,7 +293,7 @@ describe('AddItemModal', () => {
     })
   })
 
-  it('adds item with remoteUrl when upload returns url', async () => {
+  it('uploads the photo to the created item', async () => {
     const { useImageProcessing } = await import('@/hooks/useImageProcessing')
     const { useUploader } = await import('@/hooks/useUploader')
 
@@ -306,8 +306,8 @@ describe('AddItemModal', () => {
     } as any)
 
     // return a successful upload result
-    const uploadMock = vi.fn().mockResolvedValue({ ok: true, data: { url: 'https://cdn.example/test.png' } })
-    vi.mocked(useUploader).mockReturnValue({ uploadDataUrl: uploadMock } as any)
+    const uploadMock = vi.fn().mockResolvedValue({ success: true, item: { id: 1 } })
+    vi.mocked(useUploader).mockReturnValue({ uploadItemPhoto: uploadMock } as any)
 
     mockDb.addItem = vi.fn().mockResolvedValue('test-id')
 
@@ -333,9 +333,9 @@ describe('AddItemModal', () => {
         name: 'Test Item',
         description: 'Test Description',
         image256: 'data:image/jpeg;base64,test',
-        fingerprint: [1, 2, 3],
-        remoteUrl: 'https://cdn.example/test.png'
+        fingerprint: [1, 2, 3]
       })
+      expect(uploadMock).toHaveBeenCalledWith('test-id', 'data:image/jpeg;base64,test')
     })
   })
 
@@ -157,7 +157,7 @@ export function AddItemModal({ isOpen, onOpenChange, db, onItemAdded }: AddItemM
     processImage,
     clearImage,
   } = useImageProcessing();
-  const { uploadDataUrl } = useUploader();
+  const { uploadItemPhoto } = useUploader();
   const {
     tagSuggestions,
     fetchQuery,
@@ -170,54 +170,17 @@ export function AddItemModal({ isOpen, onOpenChange, db, onItemAdded }: AddItemM
     clearTags,
   } = useTags();
 
-  // upload status & remote url
-  const [uploadStatus, setUploadStatus] = useState<
-    "idle" | "uploading" | "done" | "error"
-  >("idle");
-  const [remoteImageUrl, setRemoteImageUrl] = useState<string | null>(null);
+  // upload status of the photo of the item being added
+  const [uploadStatus, setUploadStatus] = useState<"idle" | "uploading">(
+    "idle"
+  );
 
   const [continueAdding, setContinueAdding] = useState(false);
 
-  // instantiate local hooks using useImageProcessing's processImage
-  // wrap the base processImage so we upload the same dataUrl afterwards (if available)
-  const processImageAndUpload = useCallback(
-    async (imageSource: string | HTMLImageElement, fileName?: string) => {
-      // run the fingerprint/processing first
-      const result = await processImage(imageSource);
-
-      // only attempt upload for dataURL strings
-      if (typeof imageSource === "string") {
-        // if no token is available in the hook it will return null and do nothing
-        try {
-          setUploadStatus("uploading");
-          const res = await uploadDataUrl(imageSource, fileName);
-          if (!res?.success) {
-            throw new Error("Error happened while uploading an image");
-          }
-
-          // try common returned properties
-          if (res.success) {
-            setRemoteImageUrl(res.data.url);
-            setUploadStatus("done");
-          } else {
-            setRemoteImageUrl(null);
-            setUploadStatus("error");
-          }
-        } catch (e) {
-          setRemoteImageUrl(null);
-          setUploadStatus("error");
-        }
-      }
-
-      return result;
-    },
-    [processImage, uploadDataUrl]
-  );
-
   const { fileInputRef, handleFileUpload: uploaderHandleFile } =
-    useFileUploader(processImageAndUpload);
+    useFileUploader(processImage);
 
-  const capture = useCapture(processImageAndUpload);
+  const capture = useCapture(processImage);
   // forward refs and functions from the local hooks (keep original names so usage stays consistent)
   const {
     videoRefCallback,
@@ -251,20 +214,30 @@ export function AddItemModal({ isOpen, onOpenChange, db, onItemAdded }: AddItemM
   const handleAddItem = async () => {
     setError(null);
 
-    if (!capturedImage || !imageFingerprint || !remoteImageUrl) {
+    if (!capturedImage || !imageFingerprint) {
       setError("Please capture or upload an image before adding to collection");
       return;
     }
 
     try {
-      await db.addItem({
+      const id = await db.addItem({
         ...itemDetails,
         fingerprint: imageFingerprint,
-        photoUrl: remoteImageUrl,
         tags: selectedTags,
       });
 
-      toast.success("Item added to collection");
+      // The photo is stored by the API once the item exists
+      setUploadStatus("uploading");
+      const upload = id
+        ? await uploadItemPhoto(id, capturedImage).catch(() => ({ success: false as const }))
+        : { success: false as const };
+      setUploadStatus("idle");
+
+      if (upload.success) {
+        toast.success("Item added to collection");
+      } else {
+        toast.error("Item added to collection, but its photo couldn't be uploaded");
+      }
 
       clearItemDetails();
       clearImage();
@@ -449,11 +422,6 @@ export function AddItemModal({ isOpen, onOpenChange, db, onItemAdded }: AddItemM
                       Uploading…
                     </div>
                   )}
-                  {uploadStatus === "done" && remoteImageUrl && (
-                    <div className="text-xs text-muted-foreground text-center mt-1">
-                      Uploaded ✓
-                    </div>
-                  )}
                 </div>
               )}
             </div>
@@ -14,6 +14,7 @@ import { type CollectionItem } from '@/types'
 import { TagsInput } from './TagsInput'
 import { useTags, type TagItem } from '@/hooks/useTags'
 import { CollectionDB } from '@/lib/db'
+import { photoSrc } from '@/lib/utils'
 import { toast } from 'sonner'
 
 const db = new CollectionDB()
@@ -96,7 +97,7 @@ export function ImageModal({ isOpen, onOpenChange, item }: ImageModalProps) {
         <div className="space-y-4">
           <div className="flex justify-center">
             <img
-              src={`${item.photoUrl}/raw`}
+              src={photoSrc(item, 'full')}
               alt={item.name}
               className="max-w-full rounded-lg border bg-black"
               style={{ maxHeight: '300px' }}
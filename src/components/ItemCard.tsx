@@ -1,4 +1,5 @@
 import { type CollectionItem } from '@/lib/db'
+import { photoSrc } from '@/lib/utils'
 
 interface ItemCardProps {
   item: CollectionItem
@@ -10,7 +11,7 @@ export function ItemCard({ item, onImageClick }: ItemCardProps) {
     <div className="flex gap-4 p-2 rounded-lg flex-col">
       <div className="w-full aspect-square bg-gray-100 rounded-md flex items-center justify-center">
         <img
-          src={`${item.photoUrl}/raw`}
+          src={photoSrc(item, 'medium')}
           alt={item.name}
           className="w-full rounded-md shadow-lg object-contain bg-white cursor-pointer hover:opacity-80 transition-opacity"
           onClick={() => onImageClick?.(item)}
@@ -1,5 +1,6 @@
 import { useState } from 'preact/hooks'
 import { type CollectionItem } from '@/lib/db'
+import { photoSrc } from '@/lib/utils'
 import { ItemCard } from './ItemCard'
 import { ImageModal } from './ImageModal'
 
@@ -69,7 +70,7 @@ function ItemRow({ item, onImageClick }: { item: CollectionItem; onImageClick: (
         onClick={() => onImageClick(item)}
       >
         <img
-          src={`${item.photoUrl}/raw`}
+          src={photoSrc(item, 'thumb')}
           alt={item.name}
           className="w-full h-full object-cover"
         />
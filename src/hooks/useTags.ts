@@ -3,7 +3,9 @@ import { useState, useCallback, useRef, useEffect } from 'preact/hooks'
 
 export type TagItem = {
   id: number;
-  name: string
+  name: string;
+  parentId?: number;
+  count?: number
 }
 
 interface TagsResponse {
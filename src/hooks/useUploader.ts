@@ -1,11 +1,11 @@
 import { useCallback } from 'preact/hooks'
-import { nanoid } from 'nanoid';
+import { type CollectionItem } from '@/types'
 
-// Simple browser uploader hook — wraps the same behaviour as the bash script
-// - reads the upload token from Vite env VITE_UPLOAD_TOKEN (optional)
-// - posts dataURL/Blob as multipart/form-data with `Authorization: Bearer <token>` and `X-File-Type`
+// Browser uploader hook — stores a captured photo as the primary photo of an
+// item with POST /api/items/{id}/photo. The API keeps the photo and serves it
+// from /api/photos/{id}, so items only ever point at photos it issued.
 
-const DEFAULT_API_URL = 'https://flare.dev.kmiecik.pl/api/files'
+const DEFAULT_ITEMS_URL = '/api/items'
 
 function dataUrlToBlob(dataUrl: string): { blob: Blob; mime: string } {
   const m = dataUrl.match(/^data:(.+);base64,(.*)$/)
@@ -20,15 +20,8 @@ function dataUrlToBlob(dataUrl: string): { blob: Blob; mime: string } {
   return { blob, mime }
 }
 
-export function useUploader() {
-  const token = typeof import.meta !== 'undefined' ? (import.meta.env?.VITE_UPLOAD_TOKEN as string | undefined) : undefined
-  const apiUrl = typeof import.meta !== 'undefined' ? (import.meta.env?.VITE_API_URL as string | undefined) ?? DEFAULT_API_URL : DEFAULT_API_URL
-
-  const uploadDataUrl = useCallback(async (dataUrl: string, fileName?: string) => {
-    if (!token) return null
-
-    fileName = nanoid()
-
+export function useUploader(itemsUrl: string = DEFAULT_ITEMS_URL) {
+  const uploadItemPhoto = useCallback(async (itemId: string | number, dataUrl: string) => {
     const { blob, mime } = dataUrlToBlob(dataUrl)
 
     const form = new FormData()
@@ -37,26 +30,17 @@ export function useUploader() {
     try {
       ext = mime.split('/')[1].split('+')[0]
     } catch { }
-    const filename = `${fileName}.${ext}`
-    form.append('file', blob, filename)
+    form.append('image', blob, `photo.${ext}`)
 
-    const headers: Record<string, string> = {
-      Authorization: `Bearer ${token}`,
-      'X-File-Type': mime,
-    }
-
-    const res = await fetch(apiUrl, { method: 'POST', headers, body: form })
-    const body = await res.json() as { data: { url: string }, success: true } | { success: false }
-
-    if (res.ok) {
-      return body;
-    }
-    return {
-      success: false as const
+    const res = await fetch(`${itemsUrl}/${encodeURIComponent(itemId)}/photo`, { method: 'POST', body: form })
+    if (!res.ok) {
+      return { success: false as const }
     }
-  }, [token, apiUrl])
+    const item = await res.json() as CollectionItem
+    return { success: true as const, item }
+  }, [itemsUrl])
 
-  return { uploadDataUrl }
+  return { uploadItemPhoto }
 }
 
 export type { }
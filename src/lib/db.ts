@@ -35,6 +35,8 @@ class CollectionDB {
       // If the server returns the created item use it; otherwise assume success
       try {
         const data = await res.json().catch(() => null)
+        // The server responds with the id of the created item
+        if (typeof data === 'number') return String(data)
         // If server returns created item including id, prefer that id
         if (data && typeof data.id === 'string') return data.id
       } catch {}
@@ -67,15 +69,26 @@ class CollectionDB {
 
   async getAllItems(): Promise<CollectionItem[]> {
     try {
-      const res = await fetch(this.baseUrl, { method: 'GET', headers: { 'Accept': 'application/json' } })
-
-      if (!res.ok) {
-        const text = await res.text().catch(() => '')
-        throw new DatabaseError(`Failed to get all items: ${res.status} ${res.statusText} ${text}`)
-      }
-
-      const data = await res.json()
-      return Array.isArray(data) ? (data as CollectionItem[]) : []
+      // The server pages items; follow nextCursor until the catalog is exhausted.
+      const items: CollectionItem[] = []
+      let cursor: string | undefined
+      do {
+        const params = new URLSearchParams({ limit: '500' })
+        if (cursor) params.set('cursor', cursor)
+        const res = await fetch(`${this.baseUrl}?${params}`, { method: 'GET', headers: { 'Accept': 'application/json' } })
+
+        if (!res.ok) {
+          const text = await res.text().catch(() => '')
+          throw new DatabaseError(`Failed to get all items: ${res.status} ${res.statusText} ${text}`)
+        }
+
+        const data = await res.json()
+        if (Array.isArray(data)) return data as CollectionItem[]
+        items.push(...((data?.items ?? []) as CollectionItem[]))
+        cursor = data?.nextCursor
+      } while (cursor)
+
+      return items
     } catch (error) {
       throw new DatabaseError(`Get all items operation failed: ${error instanceof Error ? error.message : 'Unknown error'}`)
     }
@@ -1,6 +1,11 @@
 import { type ClassValue, clsx } from "clsx"
 import { twMerge } from "tailwind-merge"
+import type { CollectionItem, PhotoSize } from "@/types"
 
 export function cn(...inputs: ClassValue[]) {
   return twMerge(clsx(inputs))
-}
\ No newline at end of file
+}
+// Photos kept by the server come in sizes, others only as the original
+export function photoSrc(item: CollectionItem, size: PhotoSize) {
+  return item.photoVariants?.[size] ?? `${item.photoUrl}/raw`
+}
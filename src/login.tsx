@@ -9,15 +9,17 @@ render(<Login />, document.getElementById('app')!)
 
 function Login() {
   const { sendPassword, loading, isSuccess, error, clearError } = useLoginFlow();
+  const [name, setName] = useState("");
   const [password, setPassword] = useState("");
   useEffect(() => {
     clearError();
-  }, [password])
+  }, [name, password])
   return (
     <div className="flex h-dvh flex-col w-screen overflow-auto p-4 gap-4 justify-center items-center">
       <div className="flex flex-col gap-4">
-        <Input placeholder="Collection password" value={password} onChange={e => setPassword((e.target as HTMLInputElement).value)} />
-        <Button disabled={loading || isSuccess} onClick={() => sendPassword(password)}>
+        <Input placeholder="Collection name" value={name} onChange={e => setName((e.target as HTMLInputElement).value)} />
+        <Input type="password" placeholder="Collection password" value={password} onChange={e => setPassword((e.target as HTMLInputElement).value)} />
+        <Button disabled={loading || isSuccess} onClick={() => sendPassword(name, password)}>
           {isSuccess ? 'Success!' : 'Login'}
         </Button>
         <span className={cn("text-red-600 text-xs text-center h-5")}>{error ?? " "}</span>
@@ -30,13 +32,14 @@ function useLoginFlow() {
   const [loading, setLoading] = useState(false);
   const [success, setSuccess] = useState(false);
   const [error, setError] = useState<null | string>(null);
-  const sendPassword = async (password: string) => {
+  const sendPassword = async (name: string, password: string) => {
     setError(null);
     setLoading(true);
 
     const res = await fetch('/auth/login', {
       method: 'POST',
       body: JSON.stringify({
+        name,
         password
       })
     })
@@ -46,8 +49,10 @@ function useLoginFlow() {
       setTimeout(() => {
         window.location.href = "/";
       }, 1000)
+    } else if (res.status === 429 || res.status === 503) {
+      setError("Too many login attempts, try again in a minute");
     } else {
-      setError("Wrong password");
+      setError("Wrong name or password");
     }
   };
   return {
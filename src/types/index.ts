@@ -3,16 +3,37 @@ export interface TagInfo {
   name: string
 }
 
+export interface TypedFingerprint {
+  readonly algorithm: 'ahash' | 'dhash' | 'phash'
+  readonly version: number
+  readonly hash: string
+}
+
+export type ItemStatus = 'owned' | 'wanted' | 'traded_away'
+
+export type AttributeValue = string | number | boolean
+
+export type PhotoSize = 'thumb' | 'medium' | 'full'
+
+export type PhotoVariants = Record<PhotoSize, string>
+
 export interface CollectionItem {
   readonly id: number
   name: string
   photoUrl: string
+  photoVariants?: PhotoVariants
+  photoCount?: number
   fingerprint: string
+  fingerprints?: TypedFingerprint[]
   tags?: TagInfo[]
+  quantity?: number
+  status?: ItemStatus
+  attributes?: Record<string, AttributeValue>
   readonly createdAt: number
 }
 
-export type CollectionItemInput = Omit<CollectionItem, 'id' | 'createdAt'>
+// Photos are uploaded once the item exists, see useUploader
+export type CollectionItemInput = Omit<CollectionItem, 'id' | 'createdAt' | 'photoUrl'>
 
 export interface SimilarityResult {
   readonly euclidean: number